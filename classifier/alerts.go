@@ -0,0 +1,100 @@
+package classifier
+
+import "sync"
+
+// scoreAlert is a callback registered with OnScoreBelow.
+type scoreAlert struct {
+	threshold float64
+	callback  func(connection string, score float64)
+	below     map[string]bool // Connections whose score is currently below the threshold
+}
+
+// scoreAlerts holds the registered score alerts and which connections have crossed them.
+type scoreAlerts struct {
+	mu     sync.Mutex
+	alerts []*scoreAlert
+}
+
+// OnScoreBelow registers a callback invoked when the smoothed score of a connection drops below threshold.
+// The callback fires once per downward crossing, it fires again only after the score has recovered to at
+// least threshold and dropped below it once more. While a connection is warming up only failed responses are
+// checked, its latency scores say too little to alert on. Callbacks run on the goroutine of the classification,
+// after the classifier has been unlocked, so they may safely use the classifiers.
+func (rcs *ResponseClassifiers) OnScoreBelow(threshold float64, callback func(connection string, score float64)) {
+	rcs.alerts.mu.Lock()
+	defer rcs.alerts.mu.Unlock()
+
+	rcs.alerts.alerts = append(rcs.alerts.alerts, &scoreAlert{
+		threshold: threshold,
+		callback:  callback,
+		below:     make(map[string]bool),
+	})
+}
+
+// checkAlerts checks the score alerts against the verdict a response of a connection resulted in.
+func (rcs *ResponseClassifiers) checkAlerts(connection string, rc *ResponseClassifier, response Response, verdict Verdict) {
+	if verdict.Warming && !rc.isFailure(response.code) {
+		return
+	}
+
+	rcs.alerts.notify(connection, verdict.Score)
+}
+
+// notify invokes the callbacks whose threshold the score of the connection has just dropped below.
+func (sa *scoreAlerts) notify(connection string, score float64) {
+	var triggered []func(string, float64)
+
+	sa.mu.Lock()
+	for _, alert := range sa.alerts {
+		below := score < alert.threshold
+		if below && !alert.below[connection] {
+			triggered = append(triggered, alert.callback)
+		}
+
+		if below {
+			alert.below[connection] = true
+		} else {
+			delete(alert.below, connection)
+		}
+	}
+	sa.mu.Unlock()
+
+	// Invoke the callbacks without holding the lock, so they can't deadlock by registering another alert
+	for _, callback := range triggered {
+		callback(connection, score)
+	}
+}
+
+// rename moves the alert state of a connection to its new name, so a renamed connection that is already below
+// a threshold doesn't trigger the callback again.
+func (sa *scoreAlerts) rename(oldConnection string, newConnection string) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+
+	for _, alert := range sa.alerts {
+		if alert.below[oldConnection] {
+			delete(alert.below, oldConnection)
+			alert.below[newConnection] = true
+		}
+	}
+}
+
+// forget drops the alert state of a connection, so a new classifier for it starts above every threshold.
+func (sa *scoreAlerts) forget(connection string) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+
+	for _, alert := range sa.alerts {
+		delete(alert.below, connection)
+	}
+}
+
+// forgetAll drops the alert state of every connection.
+func (sa *scoreAlerts) forgetAll() {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+
+	for _, alert := range sa.alerts {
+		clear(alert.below)
+	}
+}
@@ -0,0 +1,87 @@
+package classifier
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOnScoreBelowFiresOncePerDownwardCrossing(t *testing.T) {
+	rcs := NewResponseClassifiers()
+	rcs.SetObserveOnly(true)
+
+	var calls []float64
+	rcs.OnScoreBelow(0.5, func(connection string, score float64) {
+		if connection != t.Name() {
+			t.Errorf("callback for connection %q, want %q", connection, t.Name())
+		}
+		calls = append(calls, score)
+	})
+
+	// Every response after the first is scored as set, the filter smooths it over the last five
+	next := 1.0
+	cfg := testConfig()
+	cfg.Options = []ResponseClassifierOption{WithScoreFunc(func(time.Duration, time.Duration, int) float64 { return next })}
+
+	dispatch := func(n int) {
+		t.Helper()
+
+		for i := 0; i < n; i++ {
+			if _, err := rcs.DispatchWithConfig(context.Background(), t.Name(), cfg, 10*time.Millisecond, 200, -1); err != nil {
+				t.Fatalf("DispatchWithConfig() error = %v", err)
+			}
+		}
+	}
+
+	// A brand-new healthy connection never pages, not even while it warms up
+	dispatch(20)
+	if len(calls) != 0 {
+		t.Fatalf("callback fired for a healthy connection with scores %v", calls)
+	}
+
+	// Staying below the threshold fires only once
+	next = 0
+	dispatch(20)
+	if len(calls) != 1 || calls[0] >= 0.5 {
+		t.Fatalf("callback scores after degrading = %v, want a single score below 0.5", calls)
+	}
+
+	// After recovering, dropping below again is a new crossing
+	next = 1
+	dispatch(20)
+	next = 0
+	dispatch(20)
+	if len(calls) != 2 {
+		t.Errorf("callback fired %d times after degrading twice, want 2", len(calls))
+	}
+}
+
+func TestRemoveClearsAlertState(t *testing.T) {
+	rcs := NewResponseClassifiers()
+	rcs.SetObserveOnly(true)
+
+	calls := 0
+	rcs.OnScoreBelow(0.5, func(string, float64) { calls++ })
+
+	// Failed responses count while warming up, they leave no doubt about the connection
+	fail := func() {
+		t.Helper()
+
+		if _, err := rcs.DispatchWithConfig(context.Background(), t.Name(), testConfig(), time.Millisecond, 503, -1); err != nil {
+			t.Fatalf("DispatchWithConfig() error = %v", err)
+		}
+	}
+
+	fail()
+	fail()
+	if calls != 1 {
+		t.Fatalf("callback fired %d times for a failing connection, want 1", calls)
+	}
+
+	// The classifier created after removing it starts above the threshold, so failing again is a new crossing
+	rcs.Remove(t.Name())
+	fail()
+	if calls != 2 {
+		t.Errorf("callback fired %d times after removing the connection and failing again, want 2", calls)
+	}
+}
@@ -0,0 +1,223 @@
+package classifier
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/robobo1221/afostoClassifier/database"
+	psqr "github.com/robobo1221/afostoClassifier/psqr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Observation is a single response of a connection, for instance replayed from a log.
+type Observation struct {
+	Duration time.Duration
+	Code     int
+	Size     int // Size of the response body in bytes, -1 when unknown
+}
+
+// storedWindows mirrors the PSQR windows of a connection as the database holds them, so they can be read without
+// querying it. It caches the windows between classifications and holds them while a batch of observations is
+// classified, persisting them at the end of the batch leaves the same windows behind as classifying the
+// observations one by one.
+type storedWindows struct {
+	current  *psqr.State // Stored current window, nil while the connection has none
+	previous *psqr.State // Stored previous window, nil while there is none
+	swapped  bool        // Whether a window was swapped out since the windows were loaded
+}
+
+// load returns the stored windows as estimators, like loadWindows reads them from the database.
+func (b *storedWindows) load(perc float64) (*psqr.Psqr, *psqr.Psqr) {
+	current := psqr.NewPsqr(perc)
+	if b.current != nil {
+		current.Restore(*b.current)
+	}
+
+	if b.previous == nil {
+		return current, nil
+	}
+
+	previous := psqr.NewPsqr(b.previous.Perc)
+	previous.Restore(*b.previous)
+
+	return current, previous
+}
+
+// swap makes the stored current window the previous one, like database.SwapPsqr. The new current window
+// starts without samples but keeps the markers until the next store, just like the row SwapPsqr creates.
+func (b *storedWindows) swap() {
+	if b.current == nil {
+		return
+	}
+
+	previous := *b.current
+	current := previous
+	current.Count = 0
+
+	b.previous, b.current = &previous, &current
+	b.swapped = true
+}
+
+// store replaces the stored current window.
+func (b *storedWindows) store(current *psqr.Psqr) {
+	state := current.State()
+	b.current = &state
+}
+
+// loadStoredWindows reads the stored windows of the classifier from the database.
+func (rc *ResponseClassifier) loadStoredWindows(ctx context.Context) (*storedWindows, error) {
+	id, previousId, current, err := rc.getPsqr(ctx, rc.percentile)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := &storedWindows{}
+	if id != -1 {
+		state := current.State()
+		stored.current = &state
+	}
+
+	if previousId != nil {
+		previous, err := rc.getPreviousPsqr(ctx, *previousId)
+		if err != nil {
+			return nil, err
+		}
+		if previous != nil {
+			state := previous.State()
+			stored.previous = &state
+		}
+	}
+
+	return stored, nil
+}
+
+// beginBatch loads the stored windows of the classifier to classify a batch of observations in memory.
+func (rc *ResponseClassifier) beginBatch(ctx context.Context) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	// Observe-only and debounced classifiers keep their windows in memory anyway
+	if rc.observeOnly || rc.debounced() {
+		return nil
+	}
+
+	if rc.batch != nil {
+		return fmt.Errorf("failed to begin batch of %s: a batch is already in progress", rc.connectionName)
+	}
+
+	batch, err := rc.loadStoredWindows(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin batch of %s: %w", rc.connectionName, err)
+	}
+	rc.batch = batch
+
+	return nil
+}
+
+// endBatch persists the windows of the batch in a single transaction and returns the classifier to reading and
+// writing the database directly. The stored windows are left untouched when persisting them fails.
+// Classifiers debouncing their writes persist their windows and keep holding them.
+func (rc *ResponseClassifier) endBatch(ctx context.Context) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.debounced() {
+		if err := rc.flush(ctx); err != nil {
+			return fmt.Errorf("failed to end batch of %s: %w", rc.connectionName, err)
+		}
+		return nil
+	}
+
+	batch := rc.batch
+	rc.batch = nil
+	// Read the persisted windows again rather than trusting the batch to match them
+	rc.windows = nil
+
+	if batch == nil {
+		return nil
+	}
+
+	if err := rc.persistWindows(ctx, batch); err != nil {
+		return fmt.Errorf("failed to end batch of %s: %w", rc.connectionName, err)
+	}
+
+	return nil
+}
+
+// persistWindows writes windows held in memory to the database in a single transaction, the window swapped out
+// last included. The stored windows are left untouched when it fails.
+func (rc *ResponseClassifier) persistWindows(ctx context.Context, windows *storedWindows) error {
+	toRecord := func(state *psqr.State) *database.PsqrState {
+		if state == nil {
+			return nil
+		}
+		return &database.PsqrState{
+			Connection: rc.connectionName,
+			Perc:       state.Perc,
+			Count:      state.Count,
+			Q:          state.Q,
+			N:          state.N,
+			Np:         state.Np,
+			Dn:         state.Dn,
+		}
+	}
+
+	var swapped *database.PsqrState
+	if windows.swapped {
+		swapped = toRecord(windows.previous)
+	}
+
+	return database.FlushPsqr(ctx, swapped, toRecord(windows.current))
+}
+
+// DispatchBatch classifies many observations of a connection in order and records their metrics, like calling
+// DispatchWithConfig for each of them, but keeps the PSQR windows in memory meanwhile and persists them once at
+// the end, in a single transaction. This amortizes the database work when replaying a large log.
+// The classifier of the connection is created with cfg if it doesn't exist yet. Responses of the connection
+// dispatched concurrently are classified against the in-memory windows too, a second batch for the same
+// connection is rejected until the first has ended. When persisting fails the stored windows are unchanged.
+// A classifier debouncing its writes, see WithDebouncedWrites, flushes its windows at the end instead.
+func (rcs *ResponseClassifiers) DispatchBatch(ctx context.Context, connection string, cfg ClassifierConfig, observations []Observation) (*ResponseClassifier, error) {
+	tracer := otel.GetTracerProvider().Tracer("connectionClassifier")
+	ctx, span := tracer.Start(ctx, "DispatchBatch")
+	defer span.End()
+
+	clock := rcs.getClock()
+	start := clock.Now()
+
+	classifier, err := rcs.getOrCreate(connection, cfg)
+	if err == nil {
+		err = classifier.beginBatch(ctx)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	for _, observation := range observations {
+		response := NewResponse(observation.Duration, observation.Code, observation.Size)
+		verdict := classifier.classifyResponse(ctx, response)
+		rcs.recordMetrics(ctx, classifier, &response, verdict.Score, 1)
+		rcs.checkAlerts(connection, classifier, response, verdict)
+	}
+
+	if err := classifier.endBatch(ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	if logger := rcs.getLogger(); logger.Enabled(ctx, slog.LevelDebug) {
+		logger.DebugContext(ctx, "classified batch",
+			slog.String("connection", connection),
+			slog.Int("observations", len(observations)),
+			slog.Duration("duration", clock.Now().Sub(start)),
+		)
+	}
+
+	return classifier, nil
+}
@@ -0,0 +1,79 @@
+package classifier
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/robobo1221/afostoClassifier/database"
+)
+
+func TestDispatchBatchMatchesDispatchingEachObservation(t *testing.T) {
+	single, batched := t.Name()+"-single", t.Name()+"-batched"
+	for _, connection := range []string{single, batched} {
+		if err := database.DeleteConnection(context.Background(), connection); err != nil {
+			t.Fatalf("DeleteConnection() error = %v", err)
+		}
+	}
+
+	// Enough observations to swap the window three times, with a failure now and then
+	r := rand.New(rand.NewSource(1))
+	observations := make([]Observation, 350)
+	for i := range observations {
+		code := 200
+		if i%37 == 0 {
+			code = 503
+		}
+		observations[i] = Observation{Duration: time.Duration(5+r.Intn(50)) * time.Millisecond, Code: code, Size: -1}
+	}
+
+	cfg := testConfig()
+	cfg.WindowSize = 100
+
+	rcs := NewResponseClassifiers()
+	var one *ResponseClassifier
+	for _, observation := range observations {
+		var err error
+		one, err = rcs.DispatchWithConfig(context.Background(), single, cfg, observation.Duration, observation.Code, observation.Size)
+		if err != nil {
+			t.Fatalf("DispatchWithConfig() error = %v", err)
+		}
+	}
+	batch, err := rcs.DispatchBatch(context.Background(), batched, cfg, observations)
+	if err != nil {
+		t.Fatalf("DispatchBatch() error = %v", err)
+	}
+
+	if one.GetScore() != batch.GetScore() || one.GetSampleCount() != batch.GetSampleCount() {
+		t.Errorf("batch score %v of %d samples, want %v of %d like dispatching each", batch.GetScore(), batch.GetSampleCount(), one.GetScore(), one.GetSampleCount())
+	}
+
+	// The stored windows match, apart from their ids
+	windows := func(connection string) (database.PsqrRecord, database.PsqrRecord) {
+		t.Helper()
+
+		current, err := database.GetPsqrFromConnection(context.Background(), connection, defaultPercentile)
+		if err != nil {
+			t.Fatalf("GetPsqrFromConnection(%s) error = %v", connection, err)
+		}
+		if current.PreviousID == nil {
+			t.Fatalf("stored window of %s has no previous window", connection)
+		}
+		previous, err := database.GetPsqr(context.Background(), *current.PreviousID)
+		if err != nil {
+			t.Fatalf("GetPsqr() error = %v", err)
+		}
+
+		current.ID, current.PreviousID, previous.ID, previous.PreviousID = 0, nil, 0, nil
+		return current, previous
+	}
+	singleCurrent, singlePrevious := windows(single)
+	batchCurrent, batchPrevious := windows(batched)
+	if batchCurrent != singleCurrent {
+		t.Errorf("stored current window of the batch = %+v, want %+v", batchCurrent, singleCurrent)
+	}
+	if batchPrevious != singlePrevious {
+		t.Errorf("stored previous window of the batch = %+v, want %+v", batchPrevious, singlePrevious)
+	}
+}
@@ -0,0 +1,41 @@
+package classifier
+
+import "math"
+
+// BlendFunc returns the weights of the previous and the current window's percentile estimate, summing to 1,
+// given the position of the response in the current window and the window size. The position ranges from 0
+// for the first response of a window to windowSize-1 for the last one.
+type BlendFunc func(posInWindow int, windowSize int) (w1 float64, w2 float64)
+
+// LinearBlend shifts the weight from the previous to the current window at a constant rate over the window.
+// It is the default.
+func LinearBlend(posInWindow int, windowSize int) (float64, float64) {
+	w2 := float64(posInWindow+1) / float64(windowSize)
+	return 1.0 - w2, w2
+}
+
+// CosineBlend shifts the weight along a cosine curve, slowly at the start and end of the window and fastest
+// halfway, so the estimate doesn't change abruptly right after a swap.
+func CosineBlend(posInWindow int, windowSize int) (float64, float64) {
+	t := float64(posInWindow+1) / float64(windowSize)
+	w2 := (1.0 - math.Cos(math.Pi*t)) / 2.0
+	return 1.0 - w2, w2
+}
+
+// StepBlend uses only the previous window for the first half of the current one and only the current window after.
+func StepBlend(posInWindow int, windowSize int) (float64, float64) {
+	if 2*(posInWindow+1) < windowSize {
+		return 1.0, 0.0
+	}
+	return 0.0, 1.0
+}
+
+// WithBlendFunc sets how the percentile estimates of the previous and current window are blended.
+// A nil blend keeps LinearBlend.
+func WithBlendFunc(blend BlendFunc) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		if blend != nil {
+			rc.blendFunc = blend
+		}
+	}
+}
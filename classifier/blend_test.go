@@ -0,0 +1,71 @@
+package classifier
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLinearBlendMatchesFixedBlend(t *testing.T) {
+	const windowSize = 10
+
+	// The fixed blend LinearBlend replaced weighed the current window by (count%windowSize+1)/windowSize
+	for count := 0; count < 3*windowSize; count++ {
+		want := float64(count%windowSize+1) / float64(windowSize)
+		w1, w2 := LinearBlend(count%windowSize, windowSize)
+		if w2 != want || w1 != 1.0-want {
+			t.Errorf("LinearBlend(%d, %d) = %v, %v, want %v, %v", count%windowSize, windowSize, w1, w2, 1.0-want, want)
+		}
+	}
+}
+
+func TestBlendFuncFromConfig(t *testing.T) {
+	rcs := NewResponseClassifiers()
+
+	// Weigh only one of the windows, so the upper limit follows either the slow previous or the fast current window
+	previousOnly := func(int, int) (float64, float64) { return 1, 0 }
+	currentOnly := func(int, int) (float64, float64) { return 0, 1 }
+
+	var positions []int
+	recording := func(posInWindow int, windowSize int) (float64, float64) {
+		if windowSize != 10 {
+			t.Errorf("blend called with window size %d, want 10", windowSize)
+		}
+		positions = append(positions, posInWindow)
+		return LinearBlend(posInWindow, windowSize)
+	}
+
+	limits := map[string]float64{}
+	for name, blend := range map[string]BlendFunc{"previous": previousOnly, "current": currentOnly, "recording": recording} {
+		cfg := testConfig()
+		cfg.WindowSize = 10
+		cfg.Options = []ResponseClassifierOption{WithBlendFunc(blend)}
+
+		var verdict Verdict
+		for i := 0; i < 15; i++ {
+			responseTime := 100 * time.Millisecond
+			if i >= 10 {
+				responseTime = 10 * time.Millisecond
+			}
+
+			classifier, err := rcs.DispatchWithConfig(context.Background(), t.Name()+"-"+name, cfg, responseTime, 200, -1)
+			if err != nil {
+				t.Fatalf("DispatchWithConfig() error = %v", err)
+			}
+			verdict = classifier.Verdict()
+		}
+		limits[name] = verdict.UpperLimit
+	}
+
+	if limits["previous"] <= limits["current"] {
+		t.Errorf("upper limit blending only the slow previous window = %v, want above %v of the fast current window",
+			limits["previous"], limits["current"])
+	}
+
+	// The blend is only consulted once there is a previous window, from the swap at the 10th response on
+	want := []int{1, 2, 3, 4, 5}
+	if len(positions) < len(want) || !slices.Equal(positions[len(positions)-len(want):], want) {
+		t.Errorf("blend called at positions %v, want it to end with %v", positions, want)
+	}
+}
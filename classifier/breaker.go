@@ -0,0 +1,95 @@
+package classifier
+
+import "fmt"
+
+// Circuit breaker states derived from the smoothed score of a connection.
+const (
+	StateClosed   = "closed"
+	StateHalfOpen = "half-open"
+	StateOpen     = "open"
+)
+
+// circuitBreaker tracks the breaker state of a connection.
+// The breaker opens when the score drops below openBelow and only closes again once the score
+// recovers above closeAbove, passing through half-open in between. This hysteresis prevents
+// the state from flapping when the score hovers around a single threshold. Once open it also
+// stays open for at least minOpen PSQR windows, so the upper limit has adapted before it closes.
+type circuitBreaker struct {
+	openBelow   float64
+	closeAbove  float64
+	minOpen     int // Consecutive windows to stay open before trying half-open
+	state       string
+	openWindows int // Consecutive windows that ended while open
+}
+
+func newCircuitBreaker() circuitBreaker {
+	return circuitBreaker{
+		openBelow:  0.3,
+		closeAbove: 0.6,
+		minOpen:    1,
+		state:      StateClosed,
+	}
+}
+
+// update moves the breaker to its next state given the latest smoothed score.
+func (cb *circuitBreaker) update(score float64) {
+	switch cb.state {
+	case StateClosed:
+		if score < cb.openBelow {
+			cb.state = StateOpen
+			cb.openWindows = 0
+		}
+	case StateOpen:
+		if score >= cb.openBelow && cb.openWindows >= cb.minOpen {
+			cb.state = StateHalfOpen
+		}
+	case StateHalfOpen:
+		if score < cb.openBelow {
+			cb.state = StateOpen
+			cb.openWindows = 0
+		} else if score >= cb.closeAbove {
+			cb.state = StateClosed
+		}
+	}
+}
+
+// windowEnded counts a PSQR window that ended while the breaker is open.
+func (cb *circuitBreaker) windowEnded() {
+	if cb.state == StateOpen {
+		cb.openWindows++
+	}
+}
+
+// WithBreakerThresholds configures when the circuit breaker opens and closes.
+// The breaker opens below openBelow, stays open for at least minOpen PSQR windows and closes above closeAbove.
+// The defaults are 0.3, 0.6 and 1 window. NewResponseClassifier rejects thresholds outside [0,1], an openBelow
+// that isn't below closeAbove and a negative minOpen.
+func WithBreakerThresholds(openBelow float64, closeAbove float64, minOpen int) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.breaker.openBelow = openBelow
+		rc.breaker.closeAbove = closeAbove
+		rc.breaker.minOpen = minOpen
+	}
+}
+
+// validateBreaker returns an error when the thresholds set with WithBreakerThresholds can't work together.
+func (rc *ResponseClassifier) validateBreaker() error {
+	cb := rc.breaker
+	if !(cb.openBelow >= 0 && cb.closeAbove <= 1 && cb.openBelow < cb.closeAbove) {
+		return fmt.Errorf("invalid breaker thresholds %v and %v for connection %s: must be between 0 and 1, opening below the closing threshold", cb.openBelow, cb.closeAbove, rc.connectionName)
+	}
+	if cb.minOpen < 0 {
+		return fmt.Errorf("invalid breaker min open %d for connection %s: must not be negative", cb.minOpen, rc.connectionName)
+	}
+
+	return nil
+}
+
+// State returns the circuit breaker state of the connection: "closed", "half-open" or "open".
+// While the connection is warming up only failed responses move the breaker, latency scores don't.
+func (rc *ResponseClassifier) State() string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.breaker.state
+}
@@ -0,0 +1,121 @@
+package classifier
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBreakerStaysClosedForHealthyNewConnection(t *testing.T) {
+	rc, err := NewResponseClassifier(t.Name(), 1, false, 1000, 0, WithObserveOnly(true))
+	if err != nil {
+		t.Fatalf("NewResponseClassifier() error = %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		rc.SetResponse(10*time.Millisecond, 200, -1)
+		rc.Classify(context.Background())
+		if state := rc.State(); state != StateClosed {
+			t.Fatalf("State() after %d healthy responses = %q, want %q", i+1, state, StateClosed)
+		}
+	}
+}
+
+func TestBreakerDegradationAndRecovery(t *testing.T) {
+	// Every response after the first is scored as set, the filter smooths it over the last five
+	next := 1.0
+	rc, err := NewResponseClassifier(t.Name(), 1, false, 20, 0, WithObserveOnly(true),
+		WithScoreFunc(func(time.Duration, time.Duration, int) float64 { return next }))
+	if err != nil {
+		t.Fatalf("NewResponseClassifier() error = %v", err)
+	}
+
+	classify := func() Verdict {
+		rc.SetResponse(10*time.Millisecond, 200, -1)
+		return rc.ClassifyVerdict(context.Background())
+	}
+
+	for i := 0; i < 10; i++ {
+		classify()
+	}
+	if state := rc.State(); state != StateClosed {
+		t.Fatalf("State() of a healthy connection = %q, want %q", state, StateClosed)
+	}
+
+	// Degrade until the smoothed score drops below 0.3
+	next = 0
+	for rc.State() == StateClosed {
+		if verdict := classify(); verdict.Score >= 0.6 && rc.State() != StateClosed {
+			t.Fatalf("breaker opened at score %v, want it to open below 0.3", verdict.Score)
+		}
+	}
+	if state := rc.State(); state != StateOpen {
+		t.Fatalf("State() after degrading = %q, want %q", state, StateOpen)
+	}
+
+	// A score between the thresholds doesn't leave the open state before a window has ended
+	next = 0.45
+	for {
+		verdict := classify()
+		if state := rc.State(); state != StateOpen {
+			t.Fatalf("State() before the window ended = %q, want %q", state, StateOpen)
+		}
+		if verdict.WindowSwapped {
+			break
+		}
+	}
+
+	// Once the window has ended it tries half-open as soon as the smoothed score is above 0.3, and stays there
+	// until the score recovers above 0.6
+	for i := 0; i < 5; i++ {
+		classify()
+	}
+	for i := 0; i < 30; i++ {
+		classify()
+		if state := rc.State(); state != StateHalfOpen {
+			t.Fatalf("State() at a score of 0.45 after a window = %q, want %q", state, StateHalfOpen)
+		}
+	}
+
+	next = 1
+	for i := 0; rc.State() != StateClosed; i++ {
+		if verdict := classify(); verdict.Score < 0.6 && rc.State() == StateClosed {
+			t.Fatalf("breaker closed at score %v, want it to close above 0.6", verdict.Score)
+		}
+		if i == 5 {
+			t.Fatalf("State() after recovering = %q, want %q", rc.State(), StateClosed)
+		}
+	}
+
+	// Degrading again from half-open reopens it right away
+	next = 0.45
+	for i := 0; i < 10; i++ {
+		classify()
+	}
+	next = 0
+	for i := 0; rc.State() != StateOpen; i++ {
+		classify()
+		if i == 5 {
+			t.Fatalf("State() after degrading again = %q, want %q", rc.State(), StateOpen)
+		}
+	}
+}
+
+func TestBreakerThresholdsAreValidated(t *testing.T) {
+	for _, tt := range []struct {
+		openBelow, closeAbove float64
+		minOpen               int
+	}{
+		{openBelow: 0.6, closeAbove: 0.3, minOpen: 1},
+		{openBelow: 0.5, closeAbove: 0.5, minOpen: 1},
+		{openBelow: -0.1, closeAbove: 0.6, minOpen: 1},
+		{openBelow: 0.3, closeAbove: 1.1, minOpen: 1},
+		{openBelow: 0.3, closeAbove: 0.6, minOpen: -1},
+	} {
+		opt := WithBreakerThresholds(tt.openBelow, tt.closeAbove, tt.minOpen)
+		if _, err := NewResponseClassifier(t.Name(), 1, false, 100, 0, opt); err == nil {
+			t.Errorf("NewResponseClassifier() with breaker thresholds %v, %v and min open %d succeeded, want an error",
+				tt.openBelow, tt.closeAbove, tt.minOpen)
+		}
+	}
+}
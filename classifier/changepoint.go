@@ -0,0 +1,66 @@
+package classifier
+
+import "math"
+
+// changeDetector detects a shift in the response time distribution of a connection using a two-sided
+// Page-Hinkley test. Deviations are taken relative to the running mean so the same sensitivity applies
+// to fast and slow connections, and are clamped so a single outlier can't signal a change on its own.
+type changeDetector struct {
+	delta      float64 // Relative deviation from the mean tolerated without accumulating evidence of a change
+	lambda     float64 // Accumulated relative deviation at which a change is signalled
+	minSamples int     // Samples to collect before a change can be signalled
+	count      int
+	mean       float64
+	upSum      float64 // Cumulative deviation used to detect an increase
+	upMin      float64
+	downSum    float64 // Cumulative deviation used to detect a decrease
+	downMax    float64
+}
+
+// update adds a response time and reports whether the distribution has changed.
+// The detector starts over after signalling a change.
+func (cd *changeDetector) update(v float64) bool {
+	cd.count++
+	cd.mean += (v - cd.mean) / float64(cd.count)
+
+	deviation := (v - cd.mean) / math.Max(cd.mean, 1.0)
+	deviation = math.Min(math.Max(deviation, -1.0), 4.0)
+
+	cd.upSum += deviation - cd.delta
+	cd.upMin = math.Min(cd.upMin, cd.upSum)
+	cd.downSum += deviation + cd.delta
+	cd.downMax = math.Max(cd.downMax, cd.downSum)
+
+	if cd.count < cd.minSamples {
+		return false
+	}
+
+	if cd.upSum-cd.upMin > cd.lambda || cd.downMax-cd.downSum > cd.lambda {
+		cd.reset()
+		return true
+	}
+
+	return false
+}
+
+func (cd *changeDetector) reset() {
+	*cd = changeDetector{
+		delta:      cd.delta,
+		lambda:     cd.lambda,
+		minSamples: cd.minSamples,
+	}
+}
+
+// WithChangeDetection starts a new PSQR window as soon as the response time distribution of the connection
+// shifts, rather than waiting for the window boundary. delta is the relative deviation from the mean response
+// time that is tolerated, lambda the accumulated relative deviation at which a shift is detected. Lower values
+// detect shifts sooner at the cost of more false detections, delta 0.5 and lambda 50 are reasonable defaults.
+func WithChangeDetection(delta float64, lambda float64) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.changeDetector = &changeDetector{
+			delta:      delta,
+			lambda:     lambda,
+			minSamples: 30,
+		}
+	}
+}
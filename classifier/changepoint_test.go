@@ -0,0 +1,60 @@
+package classifier
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// classifyUntilSwap classifies n successful responses of responseTime plus up to 39 milliseconds of jitter
+// and returns the 1-based index of the first response that swapped the window, 0 when none did.
+func classifyUntilSwap(t *testing.T, rc *ResponseClassifier, n int, responseTime time.Duration) int {
+	t.Helper()
+
+	for i := 1; i <= n; i++ {
+		rc.SetResponse(responseTime+time.Duration(i%40)*time.Millisecond, 200, -1)
+		if rc.ClassifyVerdict(context.Background()).WindowSwapped {
+			return i
+		}
+	}
+
+	return 0
+}
+
+func TestChangeDetectionSwapsWindowOnShift(t *testing.T) {
+	cfg := testConfig()
+	cfg.Options = []ResponseClassifierOption{WithChangeDetection(0.5, 50)}
+
+	rc, err := NewResponseClassifiers().getOrCreate(t.Name(), cfg)
+	if err != nil {
+		t.Fatalf("getOrCreate() error = %v", err)
+	}
+
+	// Jitter around a stable mean is no shift, and the window of 10000 doesn't end on its own either
+	if got := classifyUntilSwap(t, rc, 500, 10*time.Millisecond); got != 0 {
+		t.Fatalf("stationary response %d swapped the window, want no swap", got)
+	}
+
+	// Responses ten times as slow start a new window long before the window boundary
+	got := classifyUntilSwap(t, rc, 200, 300*time.Millisecond)
+	if got == 0 || got > 50 {
+		t.Fatalf("window swapped after %d slow responses, want a swap within 50", got)
+	}
+	if count := rc.GetSampleCount(); count != 1 {
+		t.Errorf("samples after the swap = %d, want 1", count)
+	}
+}
+
+func TestChangeDetectorIgnoresOutlier(t *testing.T) {
+	cd := &changeDetector{delta: 0.5, lambda: 50, minSamples: 30}
+
+	for i := 0; i < 100; i++ {
+		v := 30.0
+		if i == 60 {
+			v = 100000
+		}
+		if cd.update(v) {
+			t.Fatalf("update(%v) of sample %d signalled a change, want a single outlier ignored", v, i)
+		}
+	}
+}
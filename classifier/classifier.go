@@ -2,11 +2,19 @@ package classifier
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"math"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,50 +24,384 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
 	ResponseClassifiersInstance *ResponseClassifiers = NewResponseClassifiers()
+
+	// discardLogger is used until a logger is set
+	discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
 )
 
 type Response struct {
-	time int
-	code int
+	time   time.Duration // Response time used for classification
+	code   int
+	size   int           // Size of the response body in bytes, -1 when unknown
+	ttfb   time.Duration // Time until the response headers were received
+	total  time.Duration // Time until the response body was fully read, -1 when not measured
+	weight int           // Responses this one stands for when only a sample is classified, 0 counts as 1
+}
+
+// observations returns the number of responses the response stands for in the PSQR window.
+func (r *Response) observations() int {
+	return max(r.weight, 1)
 }
 
 type ResponseClassifier struct {
 	mu                sync.Mutex
 	connectionName    string
-	maxPercentileMult float32
-	maxAbsoluteTime   int
+	maxPercentileMult float64
+	maxAbsoluteTime   time.Duration // Cap on the upper limit a response is scored against, 0 or less disables it
+	minUpperLimit     time.Duration // Floor of the upper limit a response is scored against, 0 disables it
 	include4xx        bool
 	currentResponse   Response
 	currentScore      float64
 	windowSize        int
+	windowDuration    time.Duration // Swap windows by age instead of by windowSize when greater than 0
+	windowStart       time.Time     // When the current window started, as far as this classifier knows
+	clock             Clock
 	lastFiveScores    []float64
+	scoreFunc         ScoreFunc
+	sloThreshold      time.Duration // Latency SLO threshold scored against instead of the percentile estimate, 0 disables it
+	sloFraction       float64       // Fraction of responses the SLO requires at or below sloThreshold
+	sloCompliance     float64       // Moving fraction of the recent responses at or below sloThreshold
+	sloSamples        int           // Responses sloCompliance is based on, capped at the window size
+	blendFunc         BlendFunc     // Weighs the percentile estimates of the previous and current window
+	breaker           circuitBreaker
+	bytesPerMs        float64         // Expected transfer rate used to normalize response times by size, 0 disables it
+	capBytesPerMs     float64         // Expected transfer rate used to extend maxAbsoluteTime by size, 0 disables it
+	fourxxPenalty     float64         // Score reduction of a 4xx response when include4xx is set, between 0 and 1
+	fivexxPenalty     float64         // Score reduction of a 5xx response, between 0 and 1
+	ignoredCodes      []int           // Status codes of responses that leave the score and the PSQR window untouched
+	errorRateWeight   float64         // Share of the error rate in the score of a successful response, 0 disables it
+	outcomes          outcomeRing     // Whether the recent responses failed, only tracked when errorRateWeight is set
+	sampleCount       int             // Number of samples in the current PSQR window
+	classifyTimeout   time.Duration   // Upper bound on the database work of a single classification, 0 disables it
+	minSamples        int             // Samples a window needs before its PSQR estimate is used instead of the exact percentile
+	percentile        float64         // Percentile of the response times responses are scored against, the key of its PSQR windows
+	warmup            warmupBuffer    // Raw response times while the PSQR has too few samples to be trusted
+	lastP90           float64         // Blended percentile estimate used by the last classification
+	lastUpperLimit    float64         // Upper limit in milliseconds responses were last scored against, 0 until one has been
+	warmingUp         bool            // Whether the connection has too little history for its score to be meaningful
+	stability         float64         // Psqr.Stability of the estimate the last response was scored against
+	windowSwapped     bool            // Whether classifying the last response started a new PSQR window
+	changeDetector    *changeDetector // Detects shifts in the response times to start a new window early, nil disables it
+	lastSeen          time.Time       // When the classifier was created or last classified a response
+	observeOnly       bool            // Keep the PSQR windows in memory instead of persisting them
+	memWindow         *psqr.Psqr      // Current PSQR window in observe-only mode
+	memPrevious       *psqr.Psqr      // Previous PSQR window in observe-only mode, nil before the first swap
+	batch             *storedWindows  // Windows held in memory while DispatchBatch runs, nil otherwise
+	windows           *storedWindows  // Stored windows read through instead of querying them, nil until loaded and after a swap
+	flushInterval     time.Duration   // Longest time changed windows are held in memory before persisting them, see WithDebouncedWrites
+	flushEvery        int             // Most observations held in memory before persisting the windows, see WithDebouncedWrites
+	unflushed         int             // Observations held in memory since the windows were last persisted
+	lastFlush         time.Time       // When the windows were last persisted, or loaded, while writes are debounced
+	pendingSwaps      int64           // Window swaps not yet counted by RecordMetrics
+	seededSwap        bool            // Start new windows from the estimate of the previous one
+	lastHistoryWrite  time.Time       // When the score was last persisted to the score history
+}
+
+// defaultPercentile is the percentile of the response times a response is scored against.
+const defaultPercentile = 0.95
+
+// seedShare is the part of the window size the seed of a seeded swap counts as, see WithSeededSwap.
+const seedShare = 10
+
+// defaultMinUpperLimit is the default floor of the upper limit a response is scored against.
+const defaultMinUpperLimit = time.Millisecond
+
+// psqrMarkers is the number of markers of the P-Square algorithm, the PSQR estimate is meaningless with fewer samples.
+const psqrMarkers = 5
+
+// defaultMinSamples is the default number of samples the PSQR needs before its estimate is used.
+const defaultMinSamples = psqrMarkers
+
+// warmupBuffer is a small ring buffer of raw response times, used to score a connection exactly
+// until the PSQR has collected enough samples.
+type warmupBuffer struct {
+	samples []float64
+	len     int
+	next    int
+}
+
+func newWarmupBuffer(size int) warmupBuffer {
+	return warmupBuffer{samples: make([]float64, size)}
+}
+
+func (wb *warmupBuffer) add(v float64) {
+	wb.samples[wb.next] = v
+	wb.next = (wb.next + 1) % len(wb.samples)
+	wb.len = min(wb.len+1, len(wb.samples))
+}
+
+// percentile returns the exact nearest-rank percentile of the buffered samples.
+func (wb *warmupBuffer) percentile(perc float64) float64 {
+	sorted := make([]float64, wb.len)
+	copy(sorted, wb.samples[:wb.len])
+	sort.Float64s(sorted)
+
+	index := int(math.Ceil(float64(wb.len)*perc)) - 1
+	index = min(max(index, 0), wb.len-1)
+
+	return sorted[index]
+}
+
+// ClassifierConfig holds the configuration of a ResponseClassifier.
+type ClassifierConfig struct {
+	MaxPercentileMult float64
+	MaxAbsoluteTime   time.Duration // 0 or less means no absolute cap
+	Include4xx        bool
+	WindowSize        int
+	MinSamples        int           // Samples before the PSQR estimate is used, 0 means the default of 5
+	Percentile        float64       // Percentile of the response times responses are scored against, 0 means the default of 0.95
+	IgnoredCodes      []int         // Status codes of responses that don't affect the score, see WithIgnoredStatusCodes
+	WindowDuration    time.Duration // Swap windows by age instead of by WindowSize when greater than 0
+
+	// Options are applied to the classifier after the ones derived from the fields above, so any option can be
+	// set for classifiers created on demand, for instance by the round tripper through a ConfigResolver.
+	// Config can't derive them from a classifier and leaves them empty.
+	Options []ResponseClassifierOption
+}
+
+// DefaultClassifierConfig returns the configuration used for connections without a specific configuration.
+func DefaultClassifierConfig() ClassifierConfig {
+	return ClassifierConfig{
+		MaxPercentileMult: 1.0,
+		MaxAbsoluteTime:   0,
+		Include4xx:        true,
+		WindowSize:        1000,
+	}
+}
+
+// ScoreFunc computes the score of a response, between 0 and 1, given its response time and the current upper limit.
+// Response times are measured, and the upper limit derived from them, with millisecond precision.
+type ScoreFunc func(responseTime time.Duration, upperLimit time.Duration, code int) float64
+
+// ResponseClassifierOption configures optional behaviour of a ResponseClassifier.
+type ResponseClassifierOption func(*ResponseClassifier)
+
+// DefaultScoreFunc scores a response by how far its response time is below or above the upper limit.
+// An upper limit of zero or less, possible while warming up on responses faster than a millisecond, scores
+// a response as perfect when it is just as fast and as failing otherwise, instead of dividing by zero.
+func DefaultScoreFunc(responseTime time.Duration, upperLimit time.Duration, code int) float64 {
+	upperLimit = max(upperLimit, 0)
+	denominator := max(upperLimit, responseTime)
+	if denominator <= 0 {
+		return 1.0
+	}
+	return float64(upperLimit-responseTime)/float64(denominator)*0.5 + 0.5 // Score between 0 and 1
+}
+
+// millis converts a time in milliseconds to a duration, saturating at the longest duration.
+func millis(ms float64) time.Duration {
+	if ms >= float64(math.MaxInt64)/float64(time.Millisecond) {
+		return math.MaxInt64
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// clampScore limits a score to [0,1]. A NaN score, for instance from a custom ScoreFunc, is treated as failing.
+func clampScore(score float64) float64 {
+	if math.IsNaN(score) {
+		return 0.0
+	}
+	return math.Min(math.Max(score, 0.0), 1.0)
+}
+
+// WithSizeNormalization subtracts the time needed to transfer the response body at bytesPerMs
+// from the response time before it is scored, so large responses aren't classified as slow
+// purely because of their size. Responses of unknown size are left untouched.
+func WithSizeNormalization(bytesPerMs float64) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.bytesPerMs = bytesPerMs
+	}
+}
+
+// WithSizeScaledCap extends the maxAbsoluteTime cap of a response by the time needed to transfer its body at
+// bytesPerMs, so a multi-megabyte download isn't flagged as slow by a cap meant for small responses. Responses
+// of unknown size, without a Content-Length, are capped at maxAbsoluteTime as before. It only changes the cap,
+// unlike WithSizeNormalization which corrects the response time itself, using both counts the transfer twice.
+// A rate of 0 disables it, NewResponseClassifier rejects negative rates.
+func WithSizeScaledCap(bytesPerMs float64) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.capBytesPerMs = bytesPerMs
+	}
+}
+
+// WithErrorPenalties sets how much a 4xx and a 5xx response reduce the score, each between 0 and 1.
+// A penalty of 1 drops the score to 0, a penalty of 0 keeps it at 1. Both default to 1.
+// The 4xx penalty only applies when the classifier includes 4xx responses.
+func WithErrorPenalties(fourxxPenalty float64, fivexxPenalty float64) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.fourxxPenalty = math.Min(math.Max(fourxxPenalty, 0), 1)
+		rc.fivexxPenalty = math.Min(math.Max(fivexxPenalty, 0), 1)
+	}
+}
+
+// WithIgnoredStatusCodes makes responses with the given status codes neutral: they are neither scored as errors
+// nor added to the PSQR window as latency samples, and leave the score unchanged. This suits codes such as
+// 304 Not Modified or 429 Too Many Requests, whose response time says little about the upstream.
+func WithIgnoredStatusCodes(codes ...int) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.ignoredCodes = slices.Clone(codes)
+	}
+}
+
+// WithMinUpperLimit sets the floor of the upper limit responses are scored against, defaults to 1ms.
+// Right after warming up the percentile estimate of a fast connection can be 0 or close to it, for instance when
+// responses take less than a millisecond, and a response would then be scored as failing for being just slightly
+// slower, or not be scored at all when both are 0. A floor of 0 disables it, NewResponseClassifier rejects
+// negative floors.
+func WithMinUpperLimit(minUpperLimit time.Duration) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.minUpperLimit = minUpperLimit
+	}
+}
+
+// WithSeededSwap starts every new window from the estimate of the window it replaces, see Psqr.ResetSeeded,
+// instead of from nothing. The new window converges faster and the blended percentile doesn't lurch right
+// after a swap. The seed counts as a tenth of the window size, at least five, of the window's samples.
+func WithSeededSwap(seeded bool) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.seededSwap = seeded
+	}
+}
+
+// WithClassifyTimeout bounds the time a classification may spend reading and persisting its PSQR.
+// When the database doesn't respond in time the observation is not persisted, so a blocked database
+// can't stall every classification of the connection.
+func WithClassifyTimeout(timeout time.Duration) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.classifyTimeout = timeout
+	}
+}
+
+// WithObserveOnly keeps the PSQR windows of the classifier in memory instead of persisting them, so it can
+// score shadow traffic without writing to the database. The estimates are lost when the classifier is.
+func WithObserveOnly(observeOnly bool) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.observeOnly = observeOnly
+	}
+}
+
+// WithTimeWindow swaps the PSQR window once it is older than windowDuration instead of once it holds windowSize
+// samples, so busy and quiet connections respond to changes equally fast. The previous window is blended in over
+// the duration of the current one. The age of a window is tracked in memory, a classifier created for a stored
+// connection starts its first window at creation. 0 restores count-based windows.
+func WithTimeWindow(windowDuration time.Duration) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.windowDuration = windowDuration
+	}
+}
+
+// WithMinSamples sets the number of samples a window needs before its PSQR estimate is trusted, defaults to 5.
+// Until then responses are scored against the exact percentile of the samples seen so far and the connection
+// reports that it is warming up. High-traffic connections can afford a larger number for a more stable start.
+// NewResponseClassifier rejects values below 5, the number of markers of the P-Square algorithm.
+func WithMinSamples(minSamples int) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.minSamples = minSamples
+	}
+}
+
+// WithPercentile sets the percentile of the response times responses are scored against, defaults to 0.95.
+// The PSQR windows are stored per percentile, so changing it for an existing connection starts from scratch.
+// NewResponseClassifier rejects values outside of (0, 1).
+func WithPercentile(percentile float64) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.percentile = percentile
+	}
+}
+
+// WithScoreFunc replaces the scoring formula used once enough samples have been collected.
+func WithScoreFunc(scoreFunc ScoreFunc) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		if scoreFunc != nil {
+			rc.scoreFunc = scoreFunc
+		}
+	}
 }
 
 type ResponseClassifiers struct {
-	classifiers        map[string]*ResponseClassifier // Map of connectionName to ResponseClassifier
-	CurrentOtelMetrics *OtelMetrics
+	mu                   sync.RWMutex                   // Guards classifiers and nameNormalizer
+	classifiers          map[string]*ResponseClassifier // Map of connectionName to ResponseClassifier
+	nameNormalizer       func(*http.Request) string     // Derives the connection name of a request
+	logger               *slog.Logger                   // Receives a record of every classification, discarded by default
+	alerts               scoreAlerts                    // Callbacks registered with OnScoreBelow
+	observeOnly          bool                           // Create classifiers that don't persist their PSQR windows
+	scoreHistoryInterval time.Duration                  // Minimum time between persisted scores of a connection, 0 disables the history
+	flushInterval        time.Duration                  // Debounced writes of the classifiers created from now on, see SetDebouncedWrites
+	flushEvery           int                            // Debounced writes of the classifiers created from now on, see SetDebouncedWrites
+	clock                Clock                          // Clock of the classifiers created from now on, the handler and the reaper
+	CurrentOtelMetrics   *OtelMetrics
 }
 
 type OtelMetrics struct {
 	ResponseTime  metric.Float64Histogram
 	TotalRequests metric.Int64Counter
 	Score         metric.Float64Histogram
+	WindowSwaps   metric.Int64Counter         // Number of PSQR windows started per connection
+	WindowSamples metric.Int64ObservableGauge // Number of samples in the current PSQR window per connection
+	StatusClass   bool                        // Label metrics with the status class ("2xx", "5xx") instead of the raw status code to bound cardinality
+
+	meter metric.Meter // Meter the instruments were created with, used to register the WindowSamples callback
 }
 
-func NewOtelMetrics() *OtelMetrics {
+// statusAttribute returns the attribute labeling a response with its status code or status class.
+func (om *OtelMetrics) statusAttribute(code int) attribute.KeyValue {
+	if om.StatusClass {
+		return attribute.String("status_class", fmt.Sprintf("%dxx", code/100))
+	}
+
+	return attribute.String("status_code", fmt.Sprintf("%d", code))
+}
+
+// DefaultResponseTimeBuckets are the bucket boundaries of the response time histogram in milliseconds.
+var DefaultResponseTimeBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// otelMetricsConfig holds the configuration of the instruments created by NewOtelMetrics.
+type otelMetricsConfig struct {
+	responseTimeBuckets []float64
+}
+
+// OtelMetricsOption configures the instruments created by NewOtelMetrics.
+type OtelMetricsOption func(*otelMetricsConfig)
+
+// WithResponseTimeBuckets sets the bucket boundaries of the response time histogram in milliseconds,
+// for instance to align them with a latency SLO. Defaults to DefaultResponseTimeBuckets.
+// Instruments are identified by their name, so when several OtelMetrics are created through the same
+// meter provider the boundaries of the first one apply to all of them.
+func WithResponseTimeBuckets(boundaries ...float64) OtelMetricsOption {
+	return func(cfg *otelMetricsConfig) {
+		cfg.responseTimeBuckets = boundaries
+	}
+}
+
+// NewOtelMetrics creates the instruments classifications are recorded with through the global meter provider.
+// An instrument that can't be created is reported to the global error handler and replaced by a no-op instrument,
+// so recording never fails.
+func NewOtelMetrics(opts ...OtelMetricsOption) *OtelMetrics {
+	cfg := otelMetricsConfig{
+		responseTimeBuckets: DefaultResponseTimeBuckets,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	meter := otel.GetMeterProvider().Meter("classifier-" + filepath.Base(os.Args[0]))
 
 	responseTime, err := meter.Float64Histogram(
 		"http_response_time",
 		metric.WithDescription("Response time of the request in milliseconds"),
 		metric.WithUnit("ms"),
+		metric.WithExplicitBucketBoundaries(cfg.responseTimeBuckets...),
 	)
 	if err != nil {
-		fmt.Printf("Error creating ResponseTime histogram: %v\n", err)
+		otel.Handle(fmt.Errorf("failed to create ResponseTime histogram: %w", err))
+		responseTime = noop.Float64Histogram{}
 	}
 
 	totalRequests, err := meter.Int64Counter(
@@ -67,7 +409,8 @@ func NewOtelMetrics() *OtelMetrics {
 		metric.WithDescription("Total number of requests"),
 	)
 	if err != nil {
-		fmt.Printf("Error creating TotalRequests counter: %v\n", err)
+		otel.Handle(fmt.Errorf("failed to create TotalRequests counter: %w", err))
+		totalRequests = noop.Int64Counter{}
 	}
 
 	score, err := meter.Float64Histogram(
@@ -77,69 +420,336 @@ func NewOtelMetrics() *OtelMetrics {
 		metric.WithExplicitBucketBoundaries(0.01, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1.0),
 	)
 	if err != nil {
-		fmt.Printf("Error creating Score histogram: %v\n", err)
+		otel.Handle(fmt.Errorf("failed to create Score histogram: %w", err))
+		score = noop.Float64Histogram{}
 	}
 
-	fmt.Println("Registered OpenTelemetry Metrics.")
+	windowSwaps, err := meter.Int64Counter(
+		"classifier_window_swaps",
+		metric.WithDescription("Number of PSQR windows started, at the window size or earlier on a change point or forced swap"),
+	)
+	if err != nil {
+		otel.Handle(fmt.Errorf("failed to create WindowSwaps counter: %w", err))
+		windowSwaps = noop.Int64Counter{}
+	}
+
+	windowSamples, err := meter.Int64ObservableGauge(
+		"classifier_window_samples",
+		metric.WithDescription("Number of samples in the current PSQR window"),
+	)
+	if err != nil {
+		otel.Handle(fmt.Errorf("failed to create WindowSamples gauge: %w", err))
+		windowSamples = noop.Int64ObservableGauge{}
+	}
 
 	return &OtelMetrics{
 		ResponseTime:  responseTime,
 		TotalRequests: totalRequests,
 		Score:         score,
+		WindowSwaps:   windowSwaps,
+		WindowSamples: windowSamples,
+		meter:         meter,
 	}
 }
 
-func NewResponseClassifier(connectionName string, maxPercentileMult float32, include4xx bool, windowSize int, maxAbsoluteTime int) *ResponseClassifier {
-	if maxAbsoluteTime < 0 {
-		maxAbsoluteTime = 1e10
+// NewResponseClassifier creates a classifier for a connection. A response is scored against maxPercentileMult
+// times the estimated percentile, capped at maxAbsoluteTime unless it is 0 or less.
+// It returns an error when windowSize is less than 1, maxPercentileMult is not positive or an option
+// sets a value out of its documented range, such as fewer than 5 min samples.
+func NewResponseClassifier(connectionName string, maxPercentileMult float64, include4xx bool, windowSize int, maxAbsoluteTime time.Duration, opts ...ResponseClassifierOption) (*ResponseClassifier, error) {
+	if windowSize < 1 {
+		return nil, fmt.Errorf("invalid window size %d for connection %s: must be at least 1", windowSize, connectionName)
+	}
+	if !(maxPercentileMult > 0) {
+		return nil, fmt.Errorf("invalid max percentile multiplier %v for connection %s: must be greater than 0", maxPercentileMult, connectionName)
 	}
 
-	return &ResponseClassifier{
+	rc := &ResponseClassifier{
 		connectionName:    connectionName,
 		maxPercentileMult: maxPercentileMult,
 		maxAbsoluteTime:   maxAbsoluteTime,
 		include4xx:        include4xx,
-		currentResponse:   Response{time: 0, code: 0},
+		currentResponse:   Response{time: 0, code: 0, size: -1, total: -1},
 		currentScore:      1.0,
 		windowSize:        windowSize,
-		lastFiveScores:    make([]float64, 5),
+		lastFiveScores:    make([]float64, 0, 5),
+		scoreFunc:         DefaultScoreFunc,
+		blendFunc:         LinearBlend,
+		breaker:           newCircuitBreaker(),
+		fourxxPenalty:     1.0,
+		fivexxPenalty:     1.0,
+		minSamples:        defaultMinSamples,
+		percentile:        defaultPercentile,
+		minUpperLimit:     defaultMinUpperLimit,
+		warmingUp:         true,
+		stability:         1.0,
+		clock:             realClock{},
 	}
+
+	for _, opt := range opts {
+		opt(rc)
+	}
+
+	rc.windowStart = rc.clock.Now()
+	rc.lastSeen = rc.windowStart
+
+	if rc.windowDuration < 0 {
+		return nil, fmt.Errorf("invalid window duration %s for connection %s: must not be negative", rc.windowDuration, connectionName)
+	}
+
+	if rc.flushInterval < 0 || rc.flushEvery < 0 {
+		return nil, fmt.Errorf("invalid debounced writes every %s or %d observations for connection %s: must not be negative", rc.flushInterval, rc.flushEvery, connectionName)
+	}
+
+	if !(rc.capBytesPerMs >= 0) {
+		return nil, fmt.Errorf("invalid size scaled cap rate %v for connection %s: must not be negative", rc.capBytesPerMs, connectionName)
+	}
+
+	if rc.minUpperLimit < 0 {
+		return nil, fmt.Errorf("invalid min upper limit %s for connection %s: must not be negative", rc.minUpperLimit, connectionName)
+	}
+
+	if !(rc.percentile > 0 && rc.percentile < 1) {
+		return nil, fmt.Errorf("invalid percentile %v for connection %s: must be between 0 and 1", rc.percentile, connectionName)
+	}
+
+	if rc.minSamples < psqrMarkers {
+		return nil, fmt.Errorf("invalid min samples %d for connection %s: must be at least %d", rc.minSamples, connectionName, psqrMarkers)
+	}
+	rc.warmup = newWarmupBuffer(rc.minSamples)
+
+	if err := rc.validateSLO(); err != nil {
+		return nil, err
+	}
+
+	if err := rc.validateErrorRateWeight(); err != nil {
+		return nil, err
+	}
+
+	if err := rc.validateBreaker(); err != nil {
+		return nil, err
+	}
+	if rc.errorRateWeight > 0 {
+		rc.outcomes = newOutcomeRing(rc.windowSize)
+	}
+
+	return rc, nil
 }
 
-func (rc *ResponseClassifier) getPreviousPsqr(id int) *psqr.Psqr {
-	_, _, foundPerc, count, q, n, np, dn := database.GetPsqr(id)
+// getPreviousPsqr returns the previous PSQR window with the given id, nil when it no longer exists.
+func (rc *ResponseClassifier) getPreviousPsqr(ctx context.Context, id int) (*psqr.Psqr, error) {
+	record, err := database.GetPsqr(ctx, id)
+	if errors.Is(err, database.ErrPsqrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	psqrObj := psqr.NewPsqr(foundPerc)
+	return restorePsqr(record, record.Perc), nil
+}
 
-	if foundPerc == 0 {
+func (rc *ResponseClassifier) getPsqr(ctx context.Context, perc float64) (int, *int, *psqr.Psqr, error) {
+	record, err := database.GetPsqrFromConnection(ctx, rc.connectionName, perc)
+	if errors.Is(err, database.ErrPsqrNotFound) {
+		// Nothing stored yet, the connection starts warming up
+		return -1, nil, psqr.NewPsqr(perc), nil
+	}
+	if err != nil {
+		return -1, nil, nil, err
+	}
+
+	return record.ID, record.PreviousID, restorePsqr(record, perc), nil
+}
+
+// restorePsqr returns an estimator continuing from a persisted record, or a new one for perc when nothing was persisted.
+func restorePsqr(record database.PsqrRecord, perc float64) *psqr.Psqr {
+	psqrObj := psqr.NewPsqr(perc)
+
+	if record.Perc == 0 {
 		return psqrObj
 	}
 
-	psqrObj.Count = count
-	psqrObj.Q = q
-	psqrObj.N = n
-	psqrObj.Np = np
-	psqrObj.Dn = dn
+	psqrObj.Restore(psqr.State{
+		Perc:  record.Perc,
+		Count: record.Count,
+		Q:     record.Q,
+		N:     record.N,
+		Np:    record.Np,
+		Dn:    record.Dn,
+	})
 
 	return psqrObj
 }
 
-func (rc *ResponseClassifier) getPsqr(perc float64) (int, any, *psqr.Psqr) {
-	id, previousPsqrId, foundPerc, count, q, n, np, dn := database.GetPsqrFromConnection(rc.connectionName, perc)
+// loadWindows returns the current PSQR window and the previous one, which is nil when there is none.
+// The windows are read from the database once and then kept in sync with every write, so changes made to the
+// database by anything but the classifier itself only show up after the next swap.
+func (rc *ResponseClassifier) loadWindows(ctx context.Context, perc float64) (*psqr.Psqr, *psqr.Psqr, error) {
+	if rc.observeOnly {
+		if rc.memWindow == nil {
+			rc.memWindow = psqr.NewPsqr(perc)
+		}
+		return rc.memWindow, rc.memPrevious, nil
+	}
 
-	psqrObj := psqr.NewPsqr(perc)
+	// Debounced writes hold the windows in memory from the first classification on
+	if rc.batch == nil && rc.debounced() {
+		windows, err := rc.loadStoredWindows(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		rc.batch = windows
+		rc.lastFlush = rc.clock.Now()
+	}
 
-	if foundPerc == 0 {
-		return -1, nil, psqrObj
+	if rc.batch != nil {
+		current, previous := rc.batch.load(perc)
+		return current, previous, nil
 	}
 
-	psqrObj.Count = count
-	psqrObj.Q = q
-	psqrObj.N = n
-	psqrObj.Np = np
-	psqrObj.Dn = dn
+	// Only query the database when the windows aren't known, on the first classification and after a swap
+	if rc.windows == nil {
+		windows, err := rc.loadStoredWindows(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		rc.windows = windows
+	}
 
-	return id, previousPsqrId, psqrObj
+	current, previous := rc.windows.load(perc)
+	return current, previous, nil
+}
+
+// swapWindow makes the current PSQR window the previous one and starts a new window.
+func (rc *ResponseClassifier) swapWindow(ctx context.Context, current *psqr.Psqr) error {
+	if rc.observeOnly {
+		previous := psqr.NewPsqr(current.Perc())
+		previous.Restore(current.State())
+		rc.memPrevious = previous
+	} else if rc.batch != nil {
+		rc.batch.swap()
+	} else {
+		rc.windows = nil
+		if _, err := database.SwapPsqr(ctx, rc.connectionName, current.Perc()); err != nil {
+			return err
+		}
+	}
+
+	rc.windowStart = rc.clock.Now()
+	rc.pendingSwaps++
+	rc.breaker.windowEnded()
+
+	if !rc.seededSwap {
+		// Reset the psqr values
+		current.Reset()
+		return nil
+	}
+
+	// Persist the seed right away, the new window would otherwise start from the unseeded copy made by the swap
+	// when the response that ended the window isn't added to it
+	current.ResetSeeded(rc.windowSize / seedShare)
+	return rc.storeWindow(ctx, current)
+}
+
+// storeWindow persists the current PSQR window, unless the classifier only observes.
+func (rc *ResponseClassifier) storeWindow(ctx context.Context, current *psqr.Psqr) error {
+	if rc.observeOnly {
+		return nil
+	}
+
+	if rc.batch != nil {
+		rc.batch.store(current)
+		if rc.debounced() {
+			rc.unflushed++
+			if rc.flushDue(rc.clock.Now()) {
+				return rc.flush(ctx)
+			}
+		}
+		return nil
+	}
+
+	if err := rc.RegisterData(ctx, current); err != nil {
+		// The write may or may not have happened, read the windows again next time
+		rc.windows = nil
+		return err
+	}
+
+	if rc.windows != nil {
+		rc.windows.store(current)
+	}
+
+	return nil
+}
+
+// normalizedTime returns the response time in milliseconds used for classification, optionally corrected for the response size.
+func (rc *ResponseClassifier) normalizedTime(response *Response) int {
+	responseTime := int(response.time.Milliseconds())
+	if rc.bytesPerMs <= 0 || response.size < 0 {
+		return responseTime
+	}
+
+	transferTime := int(float64(response.size) / rc.bytesPerMs)
+	return max(responseTime-transferTime, 0)
+}
+
+// blendedPercentile returns the percentile estimate of the current window, blended with the previous window when there is one.
+func (rc *ResponseClassifier) blendedPercentile(current *psqr.Psqr, previous *psqr.Psqr) float64 {
+	p90 := current.Get()
+
+	if previous != nil {
+		w1, w2 := rc.blendWeights(current)
+		p90 = w1*previous.Get() + w2*p90
+	}
+
+	return p90
+}
+
+// blendWeights returns the weights of the previous and current window, given how far the current window has progressed.
+// Windows swapped by age progress in milliseconds instead of samples.
+func (rc *ResponseClassifier) blendWeights(current *psqr.Psqr) (float64, float64) {
+	if rc.windowDuration > 0 {
+		size := max(int(rc.windowDuration.Milliseconds()), 1)
+		elapsed := int(rc.clock.Now().Sub(rc.windowStart).Milliseconds())
+		return rc.blendFunc(min(max(elapsed, 0), size-1), size)
+	}
+
+	return rc.blendFunc(current.Count()%rc.windowSize, rc.windowSize)
+}
+
+// windowEnded reports whether the current window is complete once the response being classified is added,
+// given the number of samples it would hold and the number of samples the response adds.
+// Windows swapped by age only end when they hold any samples.
+func (rc *ResponseClassifier) windowEnded(current *psqr.Psqr, n int, weight int) bool {
+	if rc.windowDuration > 0 {
+		return current.Count() > 0 && rc.clock.Now().Sub(rc.windowStart) >= rc.windowDuration
+	}
+
+	// A weighted response may step over the window size rather than land on it
+	return n/rc.windowSize > (n-weight)/rc.windowSize
+}
+
+// upperLimit returns the response time in milliseconds a response is scored against given the percentile estimate
+// and the size of its body, -1 when unknown.
+// It is never below the floor set with WithMinUpperLimit, not even when capped by maxAbsoluteTime.
+func (rc *ResponseClassifier) upperLimit(p90 float64, size int) float64 {
+	upperLimit := rc.maxPercentileMult * p90
+	if rc.maxAbsoluteTime > 0 {
+		upperLimit = math.Min(upperLimit, rc.absoluteCap(size))
+	}
+
+	return math.Max(upperLimit, float64(rc.minUpperLimit)/float64(time.Millisecond))
+}
+
+// absoluteCap returns maxAbsoluteTime in milliseconds, extended by the transfer time of a response body of
+// size bytes when WithSizeScaledCap is set and the size is known.
+func (rc *ResponseClassifier) absoluteCap(size int) float64 {
+	limit := float64(rc.maxAbsoluteTime.Milliseconds())
+	if rc.capBytesPerMs <= 0 || size < 0 {
+		return limit
+	}
+
+	return limit + float64(size)/rc.capBytesPerMs
 }
 
 func (rc *ResponseClassifier) applyLowPassFilter(score float64) float64 {
@@ -148,7 +758,7 @@ func (rc *ResponseClassifier) applyLowPassFilter(score float64) float64 {
 		rc.lastFiveScores = rc.lastFiveScores[1:]
 	}
 
-	// Calculate the average of the last five scores
+	// Calculate the average of the last five scores, of the scores so far for a new connection
 	average := 0.0
 	for _, s := range rc.lastFiveScores {
 		average += s
@@ -158,18 +768,80 @@ func (rc *ResponseClassifier) applyLowPassFilter(score float64) float64 {
 	return average
 }
 
+// Classify classifies the current response and returns the resulting score. A cancelled ctx doesn't stop the
+// classification, only persisting the response is skipped.
 func (rc *ResponseClassifier) Classify(ctx context.Context) float64 {
 	rc.mu.Lock()
 	defer rc.mu.Unlock()
 
-	_, span := otel.GetTracerProvider().Tracer("connectionClassifier").Start(ctx, "Classify")
+	return rc.classify(ctx)
+}
+
+// ClassifyVerdict classifies the current response like Classify and returns the verdict it resulted in,
+// taken before a concurrent classification can change it. Verdict.WindowSwapped reports whether the response
+// crossed a window boundary.
+func (rc *ResponseClassifier) ClassifyVerdict(ctx context.Context) Verdict {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.classify(ctx)
+	return rc.verdict()
+}
+
+// classifyResponse sets the response and classifies it without unlocking the classifier in between, so a
+// concurrent classification can't replace the response before it is classified and each response is
+// classified exactly once. It returns the verdict the response resulted in.
+func (rc *ResponseClassifier) classifyResponse(ctx context.Context, response Response) Verdict {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.currentResponse = response
+	rc.classify(ctx)
+	return rc.verdict()
+}
+
+// isFailure reports whether a response with the given status code is scored as a failure rather than by its latency.
+func (rc *ResponseClassifier) isFailure(code int) bool {
+	return (code >= 400 && rc.include4xx) || code >= 500
+}
+
+// classify classifies the current response, the caller must hold rc.mu.
+func (rc *ResponseClassifier) classify(ctx context.Context) float64 {
+	ctx, span := otel.GetTracerProvider().Tracer("connectionClassifier").Start(ctx, "Classify")
 	defer span.End()
 
+	rc.lastSeen = rc.clock.Now()
+	rc.windowSwapped = false
+
+	// Neutral responses don't count as samples nor as errors
+	if slices.Contains(rc.ignoredCodes, rc.currentResponse.code) {
+		span.AddEvent("Classification skipped", trace.WithAttributes(attribute.String("reason", "ignored status code")))
+		return rc.currentScore
+	}
+
+	// Classify even when ctx is cancelled, only the persistence below respects it. The time spent waiting on the
+	// database while holding the lock is bounded regardless.
+	dbCtx := context.WithoutCancel(ctx)
+	if rc.classifyTimeout > 0 {
+		var cancel context.CancelFunc
+		dbCtx, cancel = context.WithTimeout(dbCtx, rc.classifyTimeout)
+		defer cancel()
+	}
+
 	// Classify response
 	response := &rc.currentResponse
-	if (response.code >= 400 && rc.include4xx) || response.code >= 500 {
-		newScore := 0.0
-		rc.currentScore = newScore
+	failed := rc.isFailure(response.code)
+	rc.recordOutcome(failed)
+
+	if failed {
+		penalty := rc.fivexxPenalty
+		if response.code < 500 {
+			penalty = rc.fourxxPenalty
+		}
+
+		newScore := 1.0 - penalty
+		rc.currentScore = clampScore(newScore)
+		rc.breaker.update(rc.currentScore)
 
 		// Error
 		span.RecordError(fmt.Errorf("Error response code: %d", response.code))
@@ -178,162 +850,850 @@ func (rc *ResponseClassifier) Classify(ctx context.Context) float64 {
 		return rc.currentScore
 	}
 
-	percentile := 0.95
+	percentile := rc.percentile
 
-	_, previousId, psqrObj := rc.getPsqr(percentile)
+	psqrObj, previousPsqr, err := rc.loadWindows(dbCtx, percentile)
+	if err != nil {
+		span.AddEvent("Classification skipped", trace.WithAttributes(attribute.String("reason", err.Error())))
+		return rc.currentScore
+	}
 
-	p90 := psqrObj.Get()
+	p90 := rc.blendedPercentile(psqrObj, previousPsqr)
 	score := 1.0
 
-	if previousId != nil {
-		prevId := int(previousId.(int64))
-		previousPsqr := rc.getPreviousPsqr(prevId)
-		prevP90 := previousPsqr.Get()
-		n := psqrObj.Count
-		w2 := float64(n%rc.windowSize+1) / float64(rc.windowSize)
-		w1 := 1.0 - w2
-		p90 = w1*prevP90 + w2*p90
+	if previousPsqr == nil && psqrObj.Count() <= rc.minSamples && rc.warmup.len > 0 {
+		// The PSQR estimate is meaningless this early, use the exact percentile of the samples seen so far
+		p90 = rc.warmup.percentile(percentile)
 	}
 
-	if previousId != nil || psqrObj.Count > 5 {
-		upperLimit := math.Min(float64(rc.maxPercentileMult)*p90, float64(rc.maxAbsoluteTime))
-		score = (upperLimit-float64(response.time))/math.Max(upperLimit, float64(response.time))*0.5 + 0.5 // Score between 0 and 1
+	rc.lastP90 = p90
+
+	span.SetAttributes(
+		attribute.Float64("classifier.p90", p90),
+		attribute.Int64("classifier.response_time_ms", response.time.Milliseconds()),
+		attribute.Int("classifier.count", psqrObj.Count()),
+	)
+
+	if rc.sloThreshold > 0 {
+		// Score the compliance of the recent responses with the SLO rather than the response itself
+		compliance := rc.updateSLOCompliance(response)
+		rc.lastUpperLimit = float64(rc.sloThreshold.Milliseconds())
+		score = rc.sloScore(compliance)
+		span.SetAttributes(attribute.Float64("classifier.slo_compliance", compliance))
+	} else if previousPsqr != nil || psqrObj.Count() > rc.minSamples || rc.warmup.len > 0 {
+		upperLimit := rc.upperLimit(p90, response.size)
+		rc.lastUpperLimit = upperLimit
+		score = rc.scoreFunc(millis(float64(rc.normalizedTime(response))), millis(upperLimit), response.code)
+		span.SetAttributes(attribute.Float64("classifier.upper_limit", upperLimit))
 	}
 
-	score = rc.applyLowPassFilter(score)
+	// Clamp before filtering so a single out-of-range score can not drag the next scores along with it
+	score = rc.applyLowPassFilter(clampScore(score))
+	span.SetAttributes(attribute.Float64("classifier.score", score))
 
 	if score < 0.5 {
-		span.RecordError(fmt.Errorf("Response time too high: %d", response.time))
-		span.SetStatus(codes.Error, fmt.Sprintf("Response time too high: %d", response.time))
+		span.RecordError(fmt.Errorf("Response time too high: %s", response.time))
+		span.SetStatus(codes.Error, fmt.Sprintf("Response time too high: %s", response.time))
 	}
 
 	// Apply the low-pass filter to smooth the score
 	//smoothedScore := rc.applyLowPassFilter(score)
-	rc.currentScore = score
+	rc.currentScore = clampScore(rc.blendErrorRate(score))
+	if !rc.warmingUp {
+		// Latency scores say little until the connection has warmed up, don't gate traffic on them
+		rc.breaker.update(rc.currentScore)
+	}
 
-	n := psqrObj.Count + 1
+	// Skip the database writes when ctx is cancelled or the database took too long to read the psqr
+	if err := errors.Join(ctx.Err(), dbCtx.Err()); err != nil {
+		span.AddEvent("Persistence skipped", trace.WithAttributes(attribute.String("reason", err.Error())))
+		return rc.currentScore
+	}
 
-	if n%rc.windowSize == 0 {
-		database.SwapPsqr(rc.connectionName, percentile)
+	weight := response.observations()
+	n := psqrObj.Count() + weight
 
-		// Reset the psqr values
-		psqrObj.Reset()
+	// Start a new window early when the response times have shifted, the current estimate no longer applies
+	changed := false
+	if rc.changeDetector != nil && response.code < 400 && rc.changeDetector.update(float64(rc.normalizedTime(response))) {
+		span.AddEvent("Change point detected")
+		changed = true
+	}
+
+	if rc.windowEnded(psqrObj, n, weight) || changed {
+		if err := rc.swapWindow(dbCtx, psqrObj); err != nil {
+			span.AddEvent("Persistence skipped", trace.WithAttributes(attribute.String("reason", err.Error())))
+			return rc.currentScore
+		}
+		rc.windowSwapped = true
 	}
 
 	// Ensure the response is successful before adding the response time to the psqr object.
 	if response.code < 400 {
-		psqrObj.Add(float64(response.time))
+		if previousPsqr == nil && psqrObj.Count() < rc.minSamples {
+			rc.warmup.add(float64(rc.normalizedTime(response)))
+		}
+
+		psqrObj.AddWeighted(float64(rc.normalizedTime(response)), weight)
 		// Update the psqr values in the database
-		rc.RegisterData(psqrObj)
+		if err := rc.storeWindow(dbCtx, psqrObj); err != nil {
+			span.AddEvent("Persistence skipped", trace.WithAttributes(attribute.String("reason", err.Error())))
+			return rc.currentScore
+		}
+	}
+
+	rc.sampleCount = psqrObj.Count()
+	rc.warmingUp = previousPsqr == nil && rc.sampleCount <= rc.minSamples
+	rc.stability = psqrObj.Stability()
+	if previousPsqr != nil {
+		// The blended estimate leans on the previous window until the current one has settled
+		rc.stability = math.Min(rc.stability, previousPsqr.Stability())
 	}
 
 	return rc.currentScore
 }
 
-func (rcs *ResponseClassifiers) RecordMetrics(ctx context.Context, rc *ResponseClassifier) {
+// ForceSwap starts a new PSQR window immediately, regardless of how many samples the current one holds,
+// for instance right after a deploy. The current window is kept as the previous one for blending.
+// It does nothing when the connection has no samples yet.
+func (rc *ResponseClassifier) ForceSwap() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	ctx := context.Background()
+
+	current, _, err := rc.loadWindows(ctx, rc.percentile)
+	if err != nil {
+		return fmt.Errorf("failed to force swap of %s: %w", rc.connectionName, err)
+	}
+
+	if current.Count() == 0 {
+		return nil
+	}
+
+	if err := rc.swapWindow(ctx, current); err != nil {
+		return fmt.Errorf("failed to force swap of %s: %w", rc.connectionName, err)
+	}
+
+	// Persist the reset window, the swap only copies the markers of the previous one
+	if err := rc.storeWindow(ctx, current); err != nil {
+		return fmt.Errorf("failed to force swap of %s: %w", rc.connectionName, err)
+	}
+
+	rc.sampleCount = 0
+
+	return nil
+}
+
+// RecordMetrics records the latest response and score of a classifier, counting it as the given number of requests.
+func (rcs *ResponseClassifiers) RecordMetrics(ctx context.Context, rc *ResponseClassifier, requests int64) {
+	rcs.recordMetrics(ctx, rc, nil, 0, requests)
+}
+
+// recordMetrics records the metrics of a classification, counting it as the given number of requests.
+// A nil response records the latest response and score of the classifier instead of the given ones, which
+// may already be those of a concurrent classification.
+func (rcs *ResponseClassifiers) recordMetrics(ctx context.Context, rc *ResponseClassifier, classified *Response, classifiedScore float64, requests int64) {
 	tracer := otel.GetTracerProvider().Tracer("connectionClassifier")
 	ctx, span := tracer.Start(ctx, "RecordMetrics")
 	defer span.End()
 
-	attrs := []attribute.KeyValue{
-		attribute.String("connection_name", rc.connectionName),
-	}
+	// Read before locking the classifier, rcs.mu is always acquired before rc.mu
+	historyInterval := rcs.getScoreHistoryInterval()
 
-	attrsForCount := append(attrs, attribute.String("status_code", fmt.Sprintf("%d", rc.currentResponse.code)))
+	// Read the classifier state under its lock since other requests may be classifying concurrently
+	rc.mu.Lock()
+	connection := rc.connectionName
+	response := rc.currentResponse
+	score := rc.currentScore
+	if classified != nil {
+		response, score = *classified, classifiedScore
+	}
+	state := rc.breaker.state
+	swaps := rc.pendingSwaps
+	rc.pendingSwaps = 0
+	now := rc.clock.Now()
+	persistScore := rc.scoreHistoryDue(now, historyInterval)
+	rc.mu.Unlock()
+
+	// Instruments may be missing when CurrentOtelMetrics was assembled by hand, skip those
+	if metrics := rcs.CurrentOtelMetrics; metrics != nil {
+		attrs := []attribute.KeyValue{
+			attribute.String("connection_name", connection),
+			attribute.String("breaker_state", state),
+			metrics.statusAttribute(response.code),
+		}
+
+		// Record metrics
+		if metrics.ResponseTime != nil {
+			metrics.ResponseTime.Record(ctx, float64(response.time)/float64(time.Millisecond), metric.WithAttributes(attrs...))
+		}
+		if metrics.TotalRequests != nil {
+			metrics.TotalRequests.Add(ctx, requests, metric.WithAttributes(attrs...))
+		}
+		if metrics.Score != nil {
+			metrics.Score.Record(ctx, score, metric.WithAttributes(attrs...))
+		}
+		if metrics.WindowSwaps != nil && swaps > 0 {
+			metrics.WindowSwaps.Add(ctx, swaps, metric.WithAttributes(attribute.String("connection_name", connection)))
+		}
+	}
 
-	// Record metrics
-	rcs.CurrentOtelMetrics.ResponseTime.Record(ctx, float64(rc.currentResponse.time), metric.WithAttributes(attrs...))
-	rcs.CurrentOtelMetrics.TotalRequests.Add(ctx, 60, metric.WithAttributes(attrsForCount...))
-	rcs.CurrentOtelMetrics.Score.Record(ctx, rc.currentScore, metric.WithAttributes(attrs...))
+	if persistScore {
+		if err := database.InsertScore(ctx, connection, now, score); err != nil {
+			span.RecordError(err)
+		}
+	}
 }
 
-func (rc *ResponseClassifier) registerPreviousData(id int, psqrObj *psqr.Psqr) {
+func (rc *ResponseClassifier) registerPreviousData(ctx context.Context, id int, psqrObj *psqr.Psqr) error {
+	state := psqrObj.State()
+
 	// Register previous data in database
-	database.UpdatePsqr(
+	return database.UpdatePsqr(
+		ctx,
 		id,
-		psqrObj.Perc,
-		psqrObj.Count,
-		psqrObj.Q[0], psqrObj.Q[1], psqrObj.Q[2], psqrObj.Q[3], psqrObj.Q[4],
-		psqrObj.N[0], psqrObj.N[1], psqrObj.N[2], psqrObj.N[3], psqrObj.N[4],
-		psqrObj.Np[0], psqrObj.Np[1], psqrObj.Np[2], psqrObj.Np[3], psqrObj.Np[4],
-		psqrObj.Dn[0], psqrObj.Dn[1], psqrObj.Dn[2], psqrObj.Dn[3], psqrObj.Dn[4],
+		state.Perc,
+		state.Count,
+		state.Q[0], state.Q[1], state.Q[2], state.Q[3], state.Q[4],
+		state.N[0], state.N[1], state.N[2], state.N[3], state.N[4],
+		state.Np[0], state.Np[1], state.Np[2], state.Np[3], state.Np[4],
+		state.Dn[0], state.Dn[1], state.Dn[2], state.Dn[3], state.Dn[4],
 	)
 }
 
-func (rc *ResponseClassifier) RegisterData(psqrObj *psqr.Psqr) {
+func (rc *ResponseClassifier) RegisterData(ctx context.Context, psqrObj *psqr.Psqr) error {
+	state := psqrObj.State()
+
 	// Register data in database
-	database.InsertConnectionWithPsqr(
+	return database.InsertConnectionWithPsqr(
+		ctx,
 		rc.connectionName,
-		psqrObj.Perc,
-		psqrObj.Count,
-		psqrObj.Q[0], psqrObj.Q[1], psqrObj.Q[2], psqrObj.Q[3], psqrObj.Q[4],
-		psqrObj.N[0], psqrObj.N[1], psqrObj.N[2], psqrObj.N[3], psqrObj.N[4],
-		psqrObj.Np[0], psqrObj.Np[1], psqrObj.Np[2], psqrObj.Np[3], psqrObj.Np[4],
-		psqrObj.Dn[0], psqrObj.Dn[1], psqrObj.Dn[2], psqrObj.Dn[3], psqrObj.Dn[4],
+		state.Perc,
+		state.Count,
+		state.Q[0], state.Q[1], state.Q[2], state.Q[3], state.Q[4],
+		state.N[0], state.N[1], state.N[2], state.N[3], state.N[4],
+		state.Np[0], state.Np[1], state.Np[2], state.Np[3], state.Np[4],
+		state.Dn[0], state.Dn[1], state.Dn[2], state.Dn[3], state.Dn[4],
 	)
 }
 
 func (rc *ResponseClassifier) GetConnectionName() string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
 	return rc.connectionName
 }
 
-func (rc *ResponseClassifier) SetResponse(time int, code int) {
+func (rc *ResponseClassifier) SetResponse(responseTime time.Duration, code int, size int) {
+	rc.setResponse(NewResponse(responseTime, code, size))
+}
+
+func (rc *ResponseClassifier) setResponse(response Response) {
 	rc.mu.Lock()
 	defer rc.mu.Unlock()
 
-	rc.currentResponse = NewResponse(time, code)
+	rc.currentResponse = response
 }
 
 func (rc *ResponseClassifier) GetResponse() Response {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
 	return rc.currentResponse
 }
 
 func (rc *ResponseClassifier) GetScore() float64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
 	return rc.currentScore
 }
 
+// Verdict is the score of a connection together with how much it can be trusted.
+type Verdict struct {
+	Score         float64
+	SampleCount   int     // Number of samples in the current PSQR window
+	Warming       bool    // Whether the connection has too little history for the score to be meaningful
+	UpperLimit    float64 // Upper limit in milliseconds responses were last scored against, 0 until one has been
+	Stability     float64 // How far the percentile estimate is from converging, 0 when settled and 1 before there is one
+	WindowSwapped bool    // Whether the last classified response ended the PSQR window and started a new one
+}
+
+// Verdict returns the current score of the connection together with its confidence.
+func (rc *ResponseClassifier) Verdict() Verdict {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.verdict()
+}
+
+// verdict returns the current verdict, the caller must hold rc.mu.
+func (rc *ResponseClassifier) verdict() Verdict {
+	return Verdict{
+		Score:         rc.currentScore,
+		SampleCount:   rc.sampleCount,
+		Warming:       rc.warmingUp,
+		UpperLimit:    rc.lastUpperLimit,
+		Stability:     rc.stability,
+		WindowSwapped: rc.windowSwapped,
+	}
+}
+
+// String summarizes the connection, its score and its configuration on a single line for debugging.
+// It locks the classifier, so it must not be called while the classifier's lock is held.
+func (rc *ResponseClassifier) String() string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return fmt.Sprintf(
+		"ResponseClassifier{connection=%s score=%.3f samples=%d window=%d mult=%g maxAbsolute=%s include4xx=%t breaker=%s}",
+		rc.connectionName, rc.currentScore, rc.sampleCount, rc.windowSize, rc.maxPercentileMult, rc.maxAbsoluteTime, rc.include4xx, rc.breaker.state,
+	)
+}
+
+// DebugDump returns the state and configuration of the classifier keyed by name, for programmatic inspection.
+// The values are copies, changing them doesn't affect the classifier.
+func (rc *ResponseClassifier) DebugDump() map[string]any {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return map[string]any{
+		"connection":        rc.connectionName,
+		"score":             rc.currentScore,
+		"sample_count":      rc.sampleCount,
+		"warming_up":        rc.warmingUp,
+		"stability":         rc.stability,
+		"last_p90":          rc.lastP90,
+		"last_upper_limit":  rc.lastUpperLimit,
+		"breaker_state":     rc.breaker.state,
+		"window_size":       rc.windowSize,
+		"window_duration":   rc.windowDuration,
+		"min_samples":       rc.minSamples,
+		"max_percentile":    rc.maxPercentileMult,
+		"max_absolute_time": rc.maxAbsoluteTime,
+		"include_4xx":       rc.include4xx,
+		"observe_only":      rc.observeOnly,
+		"last_seen":         rc.lastSeen,
+		"last_five_scores":  append([]float64(nil), rc.lastFiveScores...),
+		"error_rate":        rc.errorRate(),
+	}
+}
+
+// LastP90 returns the percentile estimate the last response was scored against, after blending
+// the previous and current windows.
+func (rc *ResponseClassifier) LastP90() float64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.lastP90
+}
+
+// LastUpperLimit returns the upper limit in milliseconds responses were last scored against, 0 until one has been.
+func (rc *ResponseClassifier) LastUpperLimit() float64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.lastUpperLimit
+}
+
+// GetSampleCount returns the number of samples in the current PSQR window.
+func (rc *ResponseClassifier) GetSampleCount() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.sampleCount
+}
+
 func (rc *ResponseClassifier) GetWindowSize() int {
 	return rc.windowSize
 }
 
-func NewResponseClassifiers() *ResponseClassifiers {
-	return &ResponseClassifiers{
+func (rc *ResponseClassifier) GetMaxPercentileMult() float64 {
+	return rc.maxPercentileMult
+}
+
+func (rc *ResponseClassifier) GetMaxAbsoluteTime() time.Duration {
+	return rc.maxAbsoluteTime
+}
+
+func (rc *ResponseClassifier) GetInclude4xx() bool {
+	return rc.include4xx
+}
+
+// Config returns the configuration the classifier was created with.
+func (rc *ResponseClassifier) Config() ClassifierConfig {
+	return ClassifierConfig{
+		MaxPercentileMult: rc.maxPercentileMult,
+		MaxAbsoluteTime:   rc.maxAbsoluteTime,
+		Include4xx:        rc.include4xx,
+		WindowSize:        rc.windowSize,
+		MinSamples:        rc.minSamples,
+		WindowDuration:    rc.windowDuration,
+		Percentile:        rc.percentile,
+		IgnoredCodes:      slices.Clone(rc.ignoredCodes),
+	}
+}
+
+// NewResponseClassifiers creates an empty set of classifiers, recording metrics through instruments configured by opts.
+func NewResponseClassifiers(opts ...OtelMetricsOption) *ResponseClassifiers {
+	rcs := &ResponseClassifiers{
 		classifiers:        make(map[string]*ResponseClassifier),
-		CurrentOtelMetrics: NewOtelMetrics(),
+		nameNormalizer:     DefaultNameNormalizer,
+		logger:             discardLogger,
+		clock:              realClock{},
+		CurrentOtelMetrics: NewOtelMetrics(opts...),
+	}
+
+	if _, err := rcs.CurrentOtelMetrics.meter.RegisterCallback(rcs.observeWindowSamples, rcs.CurrentOtelMetrics.WindowSamples); err != nil {
+		otel.Handle(fmt.Errorf("failed to register WindowSamples callback: %w", err))
+	}
+
+	return rcs
+}
+
+// observeWindowSamples reports the number of samples in the current PSQR window of every known connection.
+func (rcs *ResponseClassifiers) observeWindowSamples(_ context.Context, observer metric.Observer) error {
+	rcs.mu.RLock()
+	defer rcs.mu.RUnlock()
+
+	if rcs.CurrentOtelMetrics == nil || rcs.CurrentOtelMetrics.WindowSamples == nil {
+		return nil
+	}
+
+	for connection, classifier := range rcs.classifiers {
+		classifier.mu.Lock()
+		count := classifier.sampleCount
+		classifier.mu.Unlock()
+
+		observer.ObserveInt64(rcs.CurrentOtelMetrics.WindowSamples, int64(count), metric.WithAttributes(attribute.String("connection_name", connection)))
+	}
+
+	return nil
+}
+
+// SetNameNormalizer sets the function deriving the connection name of a request, so variants of
+// the same host share a single classifier. A nil normalizer restores DefaultNameNormalizer.
+func (rcs *ResponseClassifiers) SetNameNormalizer(normalizer func(*http.Request) string) {
+	rcs.mu.Lock()
+	defer rcs.mu.Unlock()
+
+	if normalizer == nil {
+		normalizer = DefaultNameNormalizer
+	}
+	rcs.nameNormalizer = normalizer
+}
+
+// SetLogger sets the logger classifications are logged to. A nil logger discards the logs again.
+func (rcs *ResponseClassifiers) SetLogger(logger *slog.Logger) {
+	rcs.mu.Lock()
+	defer rcs.mu.Unlock()
+
+	if logger == nil {
+		logger = discardLogger
 	}
+	rcs.logger = logger
 }
 
-func (rcs *ResponseClassifiers) DispatchWithParamsAndClassify(ctx context.Context, connection string, maxPercentileMult float32, include4xx bool, windowSize int, maxAbsoluteTime int, respTime int, code int) *ResponseClassifier {
+func (rcs *ResponseClassifiers) getLogger() *slog.Logger {
+	rcs.mu.RLock()
+	defer rcs.mu.RUnlock()
+
+	return rcs.logger
+}
+
+// SetClock sets the clock the classifiers created from now on read the time from, like WithClock, and the one
+// ClassifyHandler measures response times with and the reaper tells idle classifiers by. Existing classifiers
+// keep their clock. A nil clock sets the system time again.
+func (rcs *ResponseClassifiers) SetClock(clock Clock) {
+	rcs.mu.Lock()
+	defer rcs.mu.Unlock()
+
+	if clock == nil {
+		clock = realClock{}
+	}
+	rcs.clock = clock
+}
+
+func (rcs *ResponseClassifiers) getClock() Clock {
+	rcs.mu.RLock()
+	defer rcs.mu.RUnlock()
+
+	return rcs.clock
+}
+
+// SetObserveOnly sets whether classifiers created from now on score responses without persisting anything,
+// see WithObserveOnly. Existing classifiers keep their mode.
+func (rcs *ResponseClassifiers) SetObserveOnly(observeOnly bool) {
+	rcs.mu.Lock()
+	defer rcs.mu.Unlock()
+
+	rcs.observeOnly = observeOnly
+}
+
+// connectionName returns the normalized connection name of a request.
+func (rcs *ResponseClassifiers) connectionName(req *http.Request) string {
+	rcs.mu.RLock()
+	normalizer := rcs.nameNormalizer
+	rcs.mu.RUnlock()
+
+	return normalizer(req)
+}
+
+// DefaultNameNormalizer lowercases the host of the request and strips the port when it is the default for the scheme.
+func DefaultNameNormalizer(req *http.Request) string {
+	host := strings.ToLower(req.URL.Hostname())
+	port := req.URL.Port()
+
+	if port != "" && !(req.URL.Scheme == "http" && port == "80") && !(req.URL.Scheme == "https" && port == "443") {
+		return net.JoinHostPort(host, port)
+	}
+
+	// Keep the brackets around IPv6 addresses
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+
+	return host
+}
+
+// WarmFromStore creates a classifier for every connection with persisted PSQR data and restores
+// its sample count, so classification continues where it left off before a restart.
+// Warmed classifiers use DefaultClassifierConfig. Call it once at startup after database.Migrate.
+func (rcs *ResponseClassifiers) WarmFromStore() error {
+	connections, err := database.ListConnections(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to warm classifiers: %w", err)
+	}
+
+	for _, connection := range connections {
+		classifier, err := rcs.getOrCreate(connection, DefaultClassifierConfig())
+		if err != nil {
+			return fmt.Errorf("failed to warm classifier %s: %w", connection, err)
+		}
+
+		_, _, psqrObj, err := classifier.getPsqr(context.Background(), classifier.percentile)
+		if err != nil {
+			return fmt.Errorf("failed to warm classifier %s: %w", connection, err)
+		}
+
+		classifier.mu.Lock()
+		classifier.sampleCount = psqrObj.Count()
+		classifier.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Get returns the classifier for a connection, if one exists.
+func (rcs *ResponseClassifiers) Get(connection string) (*ResponseClassifier, bool) {
+	rcs.mu.RLock()
+	defer rcs.mu.RUnlock()
+
+	classifier, ok := rcs.classifiers[connection]
+	return classifier, ok
+}
+
+// Snapshot returns the current score of every known connection.
+func (rcs *ResponseClassifiers) Snapshot() map[string]float64 {
+	rcs.mu.RLock()
+	defer rcs.mu.RUnlock()
+
+	scores := make(map[string]float64, len(rcs.classifiers))
+	for connection, classifier := range rcs.classifiers {
+		classifier.mu.Lock()
+		scores[connection] = classifier.currentScore
+		classifier.mu.Unlock()
+	}
+
+	return scores
+}
+
+// ScoreSummary describes the current state of a connection's classifier.
+type ScoreSummary struct {
+	Score  float64 `json:"score"`
+	Count  int     `json:"count"`  // Number of samples in the current PSQR window
+	P95    float64 `json:"p95"`    // Percentile estimate the last response was scored against
+	Warmup bool    `json:"warmup"` // Whether the connection is still collecting its first samples
+}
+
+// Summaries returns the score, sample count and percentile estimate of every known connection.
+func (rcs *ResponseClassifiers) Summaries() map[string]ScoreSummary {
+	rcs.mu.RLock()
+	defer rcs.mu.RUnlock()
+
+	summaries := make(map[string]ScoreSummary, len(rcs.classifiers))
+	for connection, classifier := range rcs.classifiers {
+		classifier.mu.Lock()
+		summaries[connection] = ScoreSummary{
+			Score:  classifier.currentScore,
+			Count:  classifier.sampleCount,
+			P95:    classifier.lastP90,
+			Warmup: classifier.warmingUp,
+		}
+		classifier.mu.Unlock()
+	}
+
+	return summaries
+}
+
+// Remove evicts the in-memory classifier of a connection. Its persisted PSQR data is kept, debounced writes
+// are flushed after evicting it, so a new classifier for the same connection continues from the stored
+// estimate. One created while the flush is still running may start from the estimate stored before it.
+func (rcs *ResponseClassifiers) Remove(connection string) {
+	rcs.mu.Lock()
+	classifier, ok := rcs.classifiers[connection]
+	delete(rcs.classifiers, connection)
+	rcs.alerts.forget(connection)
+	rcs.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	// Flush without holding rcs.mu, so lookups of other connections don't wait for the database
+	classifier.mu.Lock()
+	err := classifier.flush(context.Background())
+	classifier.mu.Unlock()
+
+	if err != nil {
+		rcs.getLogger().Warn("failed to flush removed classifier", slog.Any("error", err))
+	}
+}
+
+// Rename moves the classifier of a connection together with its persisted PSQRs and score history to a new name,
+// for instance when a service moved to a new host, so it keeps its history instead of starting cold.
+// It fails with an error matching database.ErrConnectionExists when newConnection already has a classifier or
+// persisted data, and with one matching database.ErrConnectionNotFound when oldConnection has neither.
+func (rcs *ResponseClassifiers) Rename(oldConnection string, newConnection string) error {
+	rcs.mu.Lock()
+	defer rcs.mu.Unlock()
+
+	if _, ok := rcs.classifiers[newConnection]; ok {
+		return fmt.Errorf("failed to rename connection %s to %s: %w", oldConnection, newConnection, database.ErrConnectionExists)
+	}
+
+	// Hold the classifier while renaming, so it doesn't persist anything under the old name in the meantime
+	classifier, ok := rcs.classifiers[oldConnection]
+	if ok {
+		classifier.mu.Lock()
+		defer classifier.mu.Unlock()
+	}
+
+	err := database.RenameConnection(context.Background(), oldConnection, newConnection)
+	if err != nil && !(ok && errors.Is(err, database.ErrConnectionNotFound)) {
+		return fmt.Errorf("failed to rename connection %s to %s: %w", oldConnection, newConnection, err)
+	}
+
+	if ok {
+		classifier.connectionName = newConnection
+		delete(rcs.classifiers, oldConnection)
+		rcs.classifiers[newConnection] = classifier
+	}
+	rcs.alerts.rename(oldConnection, newConnection)
+
+	return nil
+}
+
+// Reset evicts the in-memory classifier of a connection and deletes its persisted PSQR data and score history,
+// so the next request for the connection starts from scratch.
+func (rcs *ResponseClassifiers) Reset(connection string) error {
+	rcs.Remove(connection)
+
+	if err := database.DeleteConnection(context.Background(), connection); err != nil {
+		return fmt.Errorf("failed to reset connection %s: %w", connection, err)
+	}
+
+	return nil
+}
+
+// ResetAll evicts every in-memory classifier and deletes all persisted PSQR data and score history.
+// No classifiers are created while the data is being deleted. A classification that was already
+// running on an evicted classifier may still persist its observation afterwards.
+func (rcs *ResponseClassifiers) ResetAll() error {
+	rcs.mu.Lock()
+	defer rcs.mu.Unlock()
+
+	rcs.classifiers = make(map[string]*ResponseClassifier)
+	rcs.alerts.forgetAll()
+
+	if err := database.TruncateAll(context.Background()); err != nil {
+		return fmt.Errorf("failed to reset classifiers: %w", err)
+	}
+
+	return nil
+}
+
+// RecomputeScore returns the score a successful response taking sampleTime would get against the persisted
+// PSQR estimate of a connection, without smoothing and without changing any state. Use it to evaluate a changed
+// scoring formula against connections that were already classified. The connection's classifier configures the
+// scoring when it exists, DefaultClassifierConfig otherwise. It returns an error when the connection has too few
+// samples for an estimate, fewer than its min samples without a previous window.
+func (rcs *ResponseClassifiers) RecomputeScore(connection string, sampleTime time.Duration) (float64, error) {
+	classifier, ok := rcs.Get(connection)
+	if !ok {
+		cfg := DefaultClassifierConfig()
+
+		var err error
+		classifier, err = NewResponseClassifier(connection, cfg.MaxPercentileMult, cfg.Include4xx, cfg.WindowSize, cfg.MaxAbsoluteTime)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return classifier.recomputeScore(context.Background(), sampleTime)
+}
+
+// recomputeScore scores a hypothetical successful response against the stored windows of the classifier.
+func (rc *ResponseClassifier) recomputeScore(ctx context.Context, sampleTime time.Duration) (float64, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	// Score against copies of the windows, loading them the way loadWindows does would cache them
+	var current, previous *psqr.Psqr
+	switch {
+	case rc.observeOnly:
+		current, previous = rc.memWindow, rc.memPrevious
+	case rc.batch != nil:
+		current, previous = rc.batch.load(rc.percentile)
+	case rc.windows != nil:
+		current, previous = rc.windows.load(rc.percentile)
+	default:
+		windows, err := rc.loadStoredWindows(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to recompute score of %s: %w", rc.connectionName, err)
+		}
+		current, previous = windows.load(rc.percentile)
+	}
+
+	if current == nil || (previous == nil && current.Count() < rc.minSamples) {
+		return 0, fmt.Errorf("failed to recompute score of %s: too few samples for an estimate", rc.connectionName)
+	}
+
+	upperLimit := rc.upperLimit(rc.blendedPercentile(current, previous), -1)
+
+	return clampScore(rc.scoreFunc(sampleTime, millis(upperLimit), http.StatusOK)), nil
+}
+
+// ClassifyObservation classifies a single observation of a connection measured outside of HTTP, for instance
+// the latency of a gRPC call or the processing time of a queued message, and returns the resulting verdict.
+// code is interpreted like an HTTP status code, pass 200 for a success and 500 for a failure.
+// The classifier of the connection is created with cfg if it doesn't exist yet, an invalid cfg is returned as an error.
+// This is the supported entry point for observations that don't pass through a ClassifierRoundTripper.
+func (rcs *ResponseClassifiers) ClassifyObservation(ctx context.Context, connection string, cfg ClassifierConfig, duration time.Duration, code int) (Verdict, error) {
+	_, verdict, err := rcs.dispatch(ctx, connection, cfg, NewResponse(duration, code, -1))
+	return verdict, err
+}
+
+// DispatchWithParamsAndClassify classifies a response of a connection, see DispatchWithConfig.
+func (rcs *ResponseClassifiers) DispatchWithParamsAndClassify(ctx context.Context, connection string, maxPercentileMult float64, include4xx bool, windowSize int, maxAbsoluteTime time.Duration, respTime time.Duration, code int, size int) (*ResponseClassifier, error) {
+	cfg := ClassifierConfig{
+		MaxPercentileMult: maxPercentileMult,
+		MaxAbsoluteTime:   maxAbsoluteTime,
+		Include4xx:        include4xx,
+		WindowSize:        windowSize,
+	}
+
+	return rcs.DispatchWithConfig(ctx, connection, cfg, respTime, code, size)
+}
+
+// DispatchWithConfig classifies a response of a connection and records its metrics.
+// The classifier of the connection is created with cfg if it doesn't exist yet, an invalid cfg is returned as an error.
+func (rcs *ResponseClassifiers) DispatchWithConfig(ctx context.Context, connection string, cfg ClassifierConfig, respTime time.Duration, code int, size int) (*ResponseClassifier, error) {
+	classifier, _, err := rcs.dispatch(ctx, connection, cfg, NewResponse(respTime, code, size))
+	return classifier, err
+}
+
+// dispatch classifies a response of a connection and records its metrics, returning the classifier and the
+// verdict the response resulted in.
+func (rcs *ResponseClassifiers) dispatch(ctx context.Context, connection string, cfg ClassifierConfig, response Response) (*ResponseClassifier, Verdict, error) {
 	tracer := otel.GetTracerProvider().Tracer("connectionClassifier")
-	ctx, span := tracer.Start(ctx, "DispatchWithParamsAndClassify")
+	ctx, span := tracer.Start(ctx, "DispatchWithConfig")
 	defer span.End()
 
-	// Check if connection already exists
+	clock := rcs.getClock()
+	start := clock.Now()
+
+	classifier, err := rcs.getOrCreate(connection, cfg)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, Verdict{}, err
+	}
+
+	verdict := classifier.classifyResponse(ctx, response)
+	score := verdict.Score
+	rcs.recordMetrics(ctx, classifier, &response, score, 1)
+	rcs.checkAlerts(connection, classifier, response, verdict)
+
+	// Check the level first so nothing is built for the log on the hot path unless debug logging is enabled
+	if logger := rcs.getLogger(); logger.Enabled(ctx, slog.LevelDebug) {
+		logger.DebugContext(ctx, "classified response",
+			slog.String("connection", connection),
+			slog.Duration("response_time", response.time),
+			slog.Int("status_code", response.code),
+			slog.Float64("score", score),
+			slog.Duration("duration", clock.Now().Sub(start)),
+		)
+	}
+
+	return classifier, verdict, nil
+}
+
+// getOrCreate returns the classifier for a connection, creating it if it doesn't exist yet.
+// Concurrent callers for the same new connection always receive the same classifier.
+// An existing classifier is returned as is, cfg is only validated when a classifier is created.
+func (rcs *ResponseClassifiers) getOrCreate(connection string, cfg ClassifierConfig) (*ResponseClassifier, error) {
+	rcs.mu.RLock()
+	classifier, ok := rcs.classifiers[connection]
+	rcs.mu.RUnlock()
+	if ok {
+		return classifier, nil
+	}
+
+	rcs.mu.Lock()
+	defer rcs.mu.Unlock()
+
+	// Another goroutine may have created it while we were waiting for the lock
 	if classifier, ok := rcs.classifiers[connection]; ok {
-		classifier.SetResponse(respTime, code)
-		classifier.Classify(ctx)
-		rcs.RecordMetrics(ctx, classifier)
-		return classifier // Return the pointer to the value
+		return classifier, nil
 	}
 
-	newClassifier := NewResponseClassifier(connection, maxPercentileMult, include4xx, windowSize, maxAbsoluteTime)
-	newClassifier.SetResponse(respTime, code)
-	newClassifier.Classify(ctx)
-	rcs.RecordMetrics(ctx, newClassifier)
+	opts := []ResponseClassifierOption{WithObserveOnly(rcs.observeOnly), WithDebouncedWrites(rcs.flushInterval, rcs.flushEvery), WithClock(rcs.clock)}
+	if cfg.MinSamples != 0 {
+		opts = append(opts, WithMinSamples(cfg.MinSamples))
+	}
+	if cfg.WindowDuration != 0 {
+		opts = append(opts, WithTimeWindow(cfg.WindowDuration))
+	}
+	if cfg.Percentile != 0 {
+		opts = append(opts, WithPercentile(cfg.Percentile))
+	}
+	if len(cfg.IgnoredCodes) > 0 {
+		opts = append(opts, WithIgnoredStatusCodes(cfg.IgnoredCodes...))
+	}
+	opts = append(opts, cfg.Options...)
 
-	rcs.classifiers[connection] = newClassifier
+	classifier, err := NewResponseClassifier(connection, cfg.MaxPercentileMult, cfg.Include4xx, cfg.WindowSize, cfg.MaxAbsoluteTime, opts...)
+	if err != nil {
+		return nil, err
+	}
+	rcs.classifiers[connection] = classifier
 
-	return newClassifier
+	return classifier, nil
 }
 
-func NewResponse(time int, code int) Response {
+func NewResponse(responseTime time.Duration, code int, size int) Response {
 	return Response{
-		time: time,
-		code: code,
+		time:  responseTime,
+		code:  code,
+		size:  size,
+		ttfb:  responseTime,
+		total: -1,
 	}
 }
 
-func (r *Response) GetTime() int {
+func (r *Response) GetTime() time.Duration {
 	return r.time
 }
 
@@ -341,22 +1701,113 @@ func (r *Response) GetCode() int {
 	return r.code
 }
 
+// GetTTFB returns the time until the response headers were received.
+func (r *Response) GetTTFB() time.Duration {
+	return r.ttfb
+}
+
+// GetTotal returns the time until the response body was fully read, or -1 when it wasn't measured.
+func (r *Response) GetTotal() time.Duration {
+	return r.total
+}
+
+// GetSize returns the size of the response body in bytes, or -1 when it is unknown.
+func (r *Response) GetSize() int {
+	return r.size
+}
+
 // Round tripper
 type ClassifierRoundTripper struct {
-	transport   http.RoundTripper
-	classifiers *ResponseClassifiers
+	transport          http.RoundTripper
+	classifiers        *ResponseClassifiers
+	configResolver     ConfigResolver
+	routeExtractor     RouteExtractor // Splits the classifier of a host per route, nil classifies per host
+	methodInKey        bool           // Splits the classifier of a host per request method
+	measureFullBody    bool
+	serverTimingMetric string        // Server-Timing metric whose duration replaces the measured time, empty disables it
+	clock              Clock         // Measures the response times
+	sampleRate         float64       // Fraction of the responses classified, the others only count towards the metrics
+	shouldClassify     RequestFilter // Requests whose responses are classified, nil classifies all of them
+}
+
+// ConfigResolver returns the classifier configuration to use for a host.
+type ConfigResolver func(host string) ClassifierConfig
+
+// RoundTripperOption configures optional behaviour of a ClassifierRoundTripper.
+type RoundTripperOption func(*ClassifierRoundTripper)
+
+// WithConfigResolver sets the resolver used to configure the classifier of each host.
+// By default every host is classified with DefaultClassifierConfig.
+func WithConfigResolver(resolver ConfigResolver) RoundTripperOption {
+	return func(t *ClassifierRoundTripper) {
+		if resolver != nil {
+			t.configResolver = resolver
+		}
+	}
+}
+
+// WithFullBodyTiming classifies responses on the time until their body is fully read instead of the
+// time until their headers arrive. This matters for streaming and chunked responses, where the headers
+// arrive long before the transfer completes, and for compressed responses, whose decompression by the
+// transport happens while the body is read. Classification happens once the caller reaches the end of
+// the body or closes it, a body that is never closed is never classified. See RoundTrip for the exact
+// window measured in each mode.
+func WithFullBodyTiming(measureFullBody bool) RoundTripperOption {
+	return func(t *ClassifierRoundTripper) {
+		t.measureFullBody = measureFullBody
+	}
+}
+
+// timedBody wraps a response body and calls onDone once, when the body is read to EOF or closed.
+type timedBody struct {
+	io.ReadCloser
+	once   sync.Once
+	onDone func()
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(b.onDone)
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.onDone)
+	return err
 }
 
+// RoundTrip sends the request through the wrapped transport and classifies its response.
+//
+// By default the measured time spans the call to the wrapped transport's RoundTrip: from sending the request
+// until the response headers have been read. The body isn't part of it, except for whatever the transport
+// happened to buffer along with the headers, so a large or slow body goes unnoticed. This holds for compressed
+// responses too: http.Transport decompresses a gzipped body transparently while it is read, after RoundTrip
+// returned, so neither the transfer nor the decompression of the body is measured.
+// With WithFullBodyTiming the time instead spans until the caller read the body to EOF or closed it, which
+// includes the transfer of the whole body and, for a transparently decompressed body, its decompression, but
+// also any time the caller spends between reads. A Server-Timing duration, see WithServerTiming, takes precedence
+// over both. Failed requests are not classified.
+// The classification happens in the context of the RoundTrip span, so its spans are children of it.
 func (t *ClassifierRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.shouldClassify != nil && !t.shouldClassify(req) {
+		return t.transport.RoundTrip(req)
+	}
+
 	// Get the tracer
 	tracer := otel.GetTracerProvider().Tracer("connectionClassifier")
-	ctx, span := tracer.Start(req.Context(), "HTTP "+req.Method+" "+req.URL.String())
+	ctx, span := tracer.Start(req.Context(), "HTTP "+req.Method+" "+req.URL.String(),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(requestAttributes(req)...),
+	)
 	defer span.End()
 
 	// Start measuring response time
-	timeStart := time.Now()
+	timeStart := t.clock.Now()
 	resp, err := t.transport.RoundTrip(req)
-	respTime := time.Since(timeStart).Milliseconds()
+	respTime := t.clock.Now().Sub(timeStart)
 
 	// Handle errors
 	if err != nil {
@@ -364,30 +1815,117 @@ func (t *ClassifierRoundTripper) RoundTrip(req *http.Request) (*http.Response, e
 		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	span.SetStatus(codes.Ok, "Request successful")
+	// The caller owns resp.Body and is responsible for closing it
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, fmt.Sprintf("Error response code: %d", resp.StatusCode))
+	} else {
+		span.SetStatus(codes.Ok, "Request successful")
+	}
 
-	// Dispatch the classifier in a goroutine
-	go t.classifiers.DispatchWithParamsAndClassify(
-		ctx,
-		req.URL.Host,
-		1.0,
-		true,
-		1000,
-		-1,
-		int(respTime),
-		resp.StatusCode,
-	)
+	host, connection := t.connectionKey(req)
+	response := NewResponse(respTime, resp.StatusCode, int(resp.ContentLength))
 
-	fmt.Printf("classified %s %d %d\n", req.URL.Host, respTime, resp.StatusCode)
+	// Prefer the processing time reported by the upstream over the measured time
+	reported := false
+	if t.serverTimingMetric != "" {
+		var duration time.Duration
+		if duration, reported = serverTiming(resp.Header, t.serverTimingMetric); reported {
+			response.time = duration
+		}
+	}
+
+	// Defer the classification until the body has been consumed
+	if t.measureFullBody {
+		resp.Body = &timedBody{
+			ReadCloser: resp.Body,
+			onDone: func() {
+				response.total = t.clock.Now().Sub(timeStart)
+				if !reported {
+					response.time = response.total
+				}
+				t.classify(ctx, host, connection, response)
+			},
+		}
+
+		return resp, nil
+	}
+
+	t.classify(ctx, host, connection, response)
 
 	return resp, nil
 }
 
-func NewClassifierRoundTripper(classifiers *ResponseClassifiers) http.RoundTripper {
-	return &ClassifierRoundTripper{
-		transport:   http.DefaultTransport,
+// requestAttributes returns the HTTP semantic convention attributes of a request, for the RoundTrip span.
+// Credentials are stripped from the URL.
+func requestAttributes(req *http.Request) []attribute.KeyValue {
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	redacted := *req.URL
+	redacted.User = nil
+
+	attrs := []attribute.KeyValue{
+		semconv.HTTPMethod(method),
+		semconv.HTTPURL(redacted.String()),
+		semconv.NetPeerName(req.URL.Hostname()),
+	}
+	if port, err := strconv.Atoi(req.URL.Port()); err == nil {
+		attrs = append(attrs, semconv.NetPeerPort(port))
+	}
+
+	return attrs
+}
+
+// classify dispatches the classification of a response in a goroutine, configured for its host.
+// A response that can't be classified, for instance because the resolved config is invalid, is logged and dropped.
+// A response left out by WithSampleRate is only recorded in the metrics.
+func (t *ClassifierRoundTripper) classify(ctx context.Context, host string, connection string, response Response) {
+	// The request context is cancelled once the body is closed or the client times out, which is usually before
+	// the goroutine gets to persist the classification
+	ctx = context.WithoutCancel(ctx)
+
+	weight, sampled := t.sample()
+	if !sampled {
+		go t.classifiers.recordUnclassified(ctx, connection, response)
+		return
+	}
+	response.weight = weight
+
+	go func() {
+		if _, _, err := t.classifiers.dispatch(ctx, connection, t.configResolver(host), response); err != nil {
+			t.classifiers.getLogger().WarnContext(ctx, "failed to classify response", slog.String("connection", connection), slog.Any("error", err))
+		}
+	}()
+}
+
+func NewClassifierRoundTripper(classifiers *ResponseClassifiers, opts ...RoundTripperOption) http.RoundTripper {
+	return NewClassifierRoundTripperWithTransport(classifiers, http.DefaultTransport, opts...)
+}
+
+// NewClassifierRoundTripperWithTransport returns a round tripper that classifies the responses of the given base transport.
+// A nil base falls back to http.DefaultTransport.
+func NewClassifierRoundTripperWithTransport(classifiers *ResponseClassifiers, base http.RoundTripper, opts ...RoundTripperOption) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	t := &ClassifierRoundTripper{
+		transport:   base,
 		classifiers: classifiers,
+		clock:       realClock{},
+		sampleRate:  1.0,
+		configResolver: func(host string) ClassifierConfig {
+			return DefaultClassifierConfig()
+		},
 	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
 }
@@ -0,0 +1,35 @@
+package classifier
+
+import "time"
+
+// Clock tells the current time, so behaviour depending on wall-clock time can be controlled in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the Clock reading the system time.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// WithClock sets the clock the classifier reads the time from, the system time by default.
+// A nil clock keeps the system time.
+func WithClock(clock Clock) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		if clock != nil {
+			rc.clock = clock
+		}
+	}
+}
+
+// WithRoundTripperClock sets the clock the round tripper measures response times with, the system time by default.
+// A nil clock keeps the system time.
+func WithRoundTripperClock(clock Clock) RoundTripperOption {
+	return func(t *ClassifierRoundTripper) {
+		if clock != nil {
+			t.clock = clock
+		}
+	}
+}
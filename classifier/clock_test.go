@@ -0,0 +1,122 @@
+package classifier
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// roundTripperFunc is an http.RoundTripper calling itself.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRoundTripperMeasuresWithClock(t *testing.T) {
+	rcs := NewResponseClassifiers()
+	rcs.SetObserveOnly(true)
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		clock.advance(37 * time.Millisecond)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok")), ContentLength: 2, Request: req}, nil
+	})
+	client := &http.Client{Transport: NewClassifierRoundTripperWithTransport(rcs, base, WithRoundTripperClock(clock))}
+
+	resp, err := client.Get("http://clock.test/")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	resp.Body.Close()
+
+	classifier := waitClassified(t, rcs, DefaultNameNormalizer(resp.Request), 1)
+	response := classifier.GetResponse()
+	if got := response.GetTime(); got != 37*time.Millisecond {
+		t.Errorf("classified response time = %s, want exactly the 37ms the fake clock advanced", got)
+	}
+}
+
+func TestClassifyHandlerMeasuresWithClock(t *testing.T) {
+	rcs := NewResponseClassifiers()
+	rcs.SetObserveOnly(true)
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	rcs.SetClock(clock)
+
+	handler := ClassifyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clock.advance(42 * time.Millisecond)
+		io.WriteString(w, "ok")
+	}), rcs, testConfig())
+
+	req := httptest.NewRequest(http.MethodGet, "/items/7", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	classifier := waitClassified(t, rcs, "GET /items/:id", 1)
+	response := classifier.GetResponse()
+	if got := response.GetTime(); got != 42*time.Millisecond {
+		t.Errorf("classified response time = %s, want exactly the 42ms the fake clock advanced", got)
+	}
+
+	// The classifier created for the route reads the same clock
+	classifier.mu.Lock()
+	lastSeen := classifier.lastSeen
+	classifier.mu.Unlock()
+	if !lastSeen.Equal(clock.Now()) {
+		t.Errorf("classifier last seen at %s, want the fake time %s", lastSeen, clock.Now())
+	}
+}
+
+func TestWindowDurationSwapsOnTimeBoundary(t *testing.T) {
+	rcs := NewResponseClassifiers()
+	rcs.SetObserveOnly(true)
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	rcs.SetClock(clock)
+
+	// One observation a minute, far fewer than the window size
+	cfg := testConfig()
+	cfg.WindowDuration = 5 * time.Minute
+	var swaps []int
+	for minute := 0; minute <= 12; minute++ {
+		verdict, err := rcs.ClassifyObservation(context.Background(), t.Name(), cfg, 10*time.Millisecond, 200)
+		if err != nil {
+			t.Fatalf("ClassifyObservation() error = %v", err)
+		}
+		if verdict.WindowSwapped {
+			swaps = append(swaps, minute)
+		}
+
+		clock.advance(time.Minute)
+	}
+
+	if want := []int{5, 10}; !slices.Equal(swaps, want) {
+		t.Errorf("minutes a window swapped = %v, want %v", swaps, want)
+	}
+}
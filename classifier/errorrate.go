@@ -0,0 +1,77 @@
+package classifier
+
+import "fmt"
+
+// outcomeRing is a ring buffer of whether the recent responses failed, keeping a running count of the failures.
+type outcomeRing struct {
+	failed   []bool
+	len      int
+	next     int
+	failures int
+}
+
+func newOutcomeRing(size int) outcomeRing {
+	return outcomeRing{failed: make([]bool, size)}
+}
+
+func (r *outcomeRing) add(failed bool) {
+	if r.len == len(r.failed) && r.failed[r.next] {
+		r.failures--
+	}
+	if failed {
+		r.failures++
+	}
+
+	r.failed[r.next] = failed
+	r.next = (r.next + 1) % len(r.failed)
+	r.len = min(r.len+1, len(r.failed))
+}
+
+// rate returns the fraction of the buffered responses that failed, 0 when there are none.
+func (r *outcomeRing) rate() float64 {
+	if r.len == 0 {
+		return 0
+	}
+
+	return float64(r.failures) / float64(r.len)
+}
+
+// WithErrorRateWeight blends the error rate of the last window size of responses into the score of successful
+// responses, so a connection serving many fast errors doesn't look healthy because its successes are fast.
+// The score becomes (1-weight) times the latency score plus weight times the success rate. The weight is between
+// 0 and 1 and defaults to 0, which scores on latency alone. Failures are the responses penalized by WithErrorPenalties.
+func WithErrorRateWeight(weight float64) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.errorRateWeight = weight
+	}
+}
+
+// validateErrorRateWeight returns an error when the weight set with WithErrorRateWeight is out of range.
+func (rc *ResponseClassifier) validateErrorRateWeight() error {
+	if !(rc.errorRateWeight >= 0 && rc.errorRateWeight <= 1) {
+		return fmt.Errorf("invalid error rate weight %v for connection %s: must be between 0 and 1", rc.errorRateWeight, rc.connectionName)
+	}
+
+	return nil
+}
+
+// recordOutcome adds whether a response failed to the error rate, when the error rate is tracked.
+func (rc *ResponseClassifier) recordOutcome(failed bool) {
+	if rc.errorRateWeight > 0 {
+		rc.outcomes.add(failed)
+	}
+}
+
+// errorRate returns the fraction of the recent responses that failed, 0 when the error rate isn't tracked.
+func (rc *ResponseClassifier) errorRate() float64 {
+	return rc.outcomes.rate()
+}
+
+// blendErrorRate blends the success rate of the recent responses into a latency score.
+func (rc *ResponseClassifier) blendErrorRate(score float64) float64 {
+	if rc.errorRateWeight <= 0 {
+		return score
+	}
+
+	return (1.0-rc.errorRateWeight)*score + rc.errorRateWeight*(1.0-rc.errorRate())
+}
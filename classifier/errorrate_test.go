@@ -0,0 +1,54 @@
+package classifier
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestErrorRateWeightFromConfig(t *testing.T) {
+	rcs := NewResponseClassifiers()
+
+	// Half of the responses fail, quickly, in between successes taking 10 to 49 milliseconds
+	classify := func(name string, opts ...ResponseClassifierOption) float64 {
+		cfg := testConfig()
+		cfg.Options = opts
+
+		var classifier *ResponseClassifier
+		for i := 0; i < 200; i++ {
+			code := 200
+			if i%2 == 0 {
+				code = 503
+			}
+
+			var err error
+			classifier, err = rcs.DispatchWithConfig(context.Background(), t.Name()+"-"+name, cfg, time.Duration(10+i%40)*time.Millisecond, code, -1)
+			if err != nil {
+				t.Fatalf("DispatchWithConfig() error = %v", err)
+			}
+		}
+
+		// The last response succeeded, so the score is that of a success
+		return classifier.GetScore()
+	}
+
+	latency := classify("latency")
+	weighted := classify("weighted", WithErrorRateWeight(0.5))
+
+	// Half of the latency score is replaced by the success rate of 0.5
+	if want := 0.5*latency + 0.25; math.Abs(weighted-want) > 1e-9 {
+		t.Errorf("score with an error rate weight of 0.5 = %v, want %v from latency score %v", weighted, want, latency)
+	}
+	if weighted >= latency {
+		t.Errorf("score with an error rate weight = %v, want below the latency score %v", weighted, latency)
+	}
+}
+
+func TestErrorRateWeightIsValidated(t *testing.T) {
+	for _, weight := range []float64{-0.1, 1.1, math.NaN()} {
+		if _, err := NewResponseClassifier(t.Name(), 1, false, 100, 0, WithErrorRateWeight(weight)); err == nil {
+			t.Errorf("NewResponseClassifier() with error rate weight %v succeeded, want an error", weight)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package classifier
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// RequestFilter reports whether the response to a request should be classified.
+type RequestFilter func(*http.Request) bool
+
+// WithRequestFilter only classifies the responses to requests the filter accepts, see HostFilter.
+// Other requests are passed to the wrapped transport untouched: they are neither timed, traced nor recorded
+// in the metrics, and never create a classifier. By default every request is classified.
+func WithRequestFilter(filter RequestFilter) RoundTripperOption {
+	return func(t *ClassifierRoundTripper) {
+		t.shouldClassify = filter
+	}
+}
+
+// HostFilter returns a filter accepting requests whose host matches any of the allow patterns and none of the
+// deny patterns. Patterns are matched against the lowercased host name without port using path.Match syntax,
+// so "*.internal" matches "metrics.internal". Without allow patterns every host not denied is accepted.
+// An error is returned for a malformed pattern.
+func HostFilter(allow []string, deny []string) (RequestFilter, error) {
+	for _, pattern := range append(append([]string(nil), allow...), deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %w", pattern, err)
+		}
+	}
+
+	matchAny := func(patterns []string, host string) bool {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(req *http.Request) bool {
+		host := strings.ToLower(req.URL.Hostname())
+		if matchAny(deny, host) {
+			return false
+		}
+		return len(allow) == 0 || matchAny(allow, host)
+	}, nil
+}
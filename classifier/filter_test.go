@@ -0,0 +1,71 @@
+package classifier
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHostFilter(t *testing.T) {
+	filter, err := HostFilter([]string{"*.example.com", "example.com"}, []string{"health.example.com", "*.INTERNAL"})
+	if err != nil {
+		t.Fatalf("HostFilter() error = %v", err)
+	}
+
+	for url, want := range map[string]bool{
+		"http://api.example.com/":           true,
+		"http://API.Example.com:8080/":      true,
+		"http://example.com/":               true,
+		"http://health.example.com/":        false,
+		"http://metrics.internal/":          false,
+		"http://other.org/":                 false,
+		"http://api.example.com.evil.test/": false,
+	} {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatalf("NewRequest(%s) error = %v", url, err)
+		}
+		if got := filter(req); got != want {
+			t.Errorf("filter(%s) = %v, want %v", url, got, want)
+		}
+	}
+
+	if _, err := HostFilter(nil, []string{"[unclosed"}); err == nil {
+		t.Error("HostFilter() with a malformed pattern succeeded, want an error")
+	}
+}
+
+func TestDeniedHostsNeverGetClassifier(t *testing.T) {
+	rcs := NewResponseClassifiers()
+	rcs.SetObserveOnly(true)
+
+	var passed atomic.Int32
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		passed.Add(1)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok")), ContentLength: 2, Request: req}, nil
+	})
+	filter, err := HostFilter(nil, []string{"*.internal"})
+	if err != nil {
+		t.Fatalf("HostFilter() error = %v", err)
+	}
+	client := &http.Client{Transport: NewClassifierRoundTripperWithTransport(rcs, base, WithRequestFilter(filter))}
+
+	for _, url := range []string{"http://metrics.internal/", "http://api.example.com/", "http://metrics.internal/health", "http://api.example.com/"} {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("Get(%s) error = %v", url, err)
+		}
+		resp.Body.Close()
+	}
+
+	// Denied requests still reach the transport, they are only left unclassified
+	if got := passed.Load(); got != 4 {
+		t.Errorf("requests passed to the transport = %d, want 4", got)
+	}
+	waitClassified(t, rcs, "api.example.com", 2)
+	if _, ok := rcs.Get("metrics.internal"); ok {
+		t.Error("a denied host got a classifier")
+	}
+}
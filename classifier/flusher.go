@@ -0,0 +1,133 @@
+package classifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// WithDebouncedWrites keeps the PSQR windows of the classifier in memory and persists them at most every
+// interval or every maxObservations observations, whichever comes first, instead of after every response.
+// Each flush writes the windows in a single transaction, a window swapped out since the last flush included.
+// A classifier only flushes while it classifies, StartFlusher flushes idle classifiers and
+// ResponseClassifiers.Flush flushes everything on shutdown. Observations held in memory are lost on a crash.
+// 0 for either disables that trigger, both 0 persists every response again. Changes made to the database by
+// anything but the classifier itself are not seen until the classifier is recreated.
+func WithDebouncedWrites(interval time.Duration, maxObservations int) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.flushInterval = interval
+		rc.flushEvery = maxObservations
+	}
+}
+
+// debounced reports whether the classifier holds its windows in memory between flushes.
+func (rc *ResponseClassifier) debounced() bool {
+	return !rc.observeOnly && (rc.flushInterval > 0 || rc.flushEvery > 0)
+}
+
+// flushDue reports whether the windows held in memory should be persisted at now. The caller must hold rc.mu.
+func (rc *ResponseClassifier) flushDue(now time.Time) bool {
+	if rc.batch == nil || (rc.unflushed == 0 && !rc.batch.swapped) {
+		return false
+	}
+
+	return (rc.flushEvery > 0 && rc.unflushed >= rc.flushEvery) ||
+		(rc.flushInterval > 0 && now.Sub(rc.lastFlush) >= rc.flushInterval)
+}
+
+// flush persists the windows held in memory when they changed since the last flush. They stay in memory
+// either way, after a failure the next flush tries again. The caller must hold rc.mu.
+func (rc *ResponseClassifier) flush(ctx context.Context) error {
+	if rc.batch == nil || (rc.unflushed == 0 && !rc.batch.swapped) {
+		return nil
+	}
+
+	if err := rc.persistWindows(ctx, rc.batch); err != nil {
+		return fmt.Errorf("failed to flush %s: %w", rc.connectionName, err)
+	}
+
+	rc.batch.swapped = false
+	rc.unflushed = 0
+	rc.lastFlush = rc.clock.Now()
+
+	return nil
+}
+
+// SetDebouncedWrites sets the debounced writes of the classifiers created from now on, see WithDebouncedWrites.
+// Existing classifiers keep their mode.
+func (rcs *ResponseClassifiers) SetDebouncedWrites(interval time.Duration, maxObservations int) {
+	rcs.mu.Lock()
+	defer rcs.mu.Unlock()
+
+	rcs.flushInterval = interval
+	rcs.flushEvery = maxObservations
+}
+
+// Flush persists the windows every classifier holds in memory, see WithDebouncedWrites. Call it on shutdown
+// after the last response was classified. A failure for one connection doesn't keep the others from flushing.
+func (rcs *ResponseClassifiers) Flush(ctx context.Context) error {
+	var errs []error
+	for _, classifier := range rcs.all() {
+		classifier.mu.Lock()
+		errs = append(errs, classifier.flush(ctx))
+		classifier.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// all returns the classifiers, so they can be visited without holding rcs.mu.
+func (rcs *ResponseClassifiers) all() []*ResponseClassifier {
+	rcs.mu.RLock()
+	defer rcs.mu.RUnlock()
+
+	classifiers := make([]*ResponseClassifier, 0, len(rcs.classifiers))
+	for _, classifier := range rcs.classifiers {
+		classifiers = append(classifiers, classifier)
+	}
+
+	return classifiers
+}
+
+// StartFlusher persists the windows held in memory by classifiers that are due, checking every interval, until
+// ctx is cancelled. Without it the windows of a connection that stopped receiving responses are only persisted
+// by Flush. It returns an error without starting when interval isn't positive.
+func (rcs *ResponseClassifiers) StartFlusher(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid flusher interval %s: must be greater than 0", interval)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				rcs.flushDue(ctx)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// flushDue flushes the classifiers whose windows are due to be persisted.
+func (rcs *ResponseClassifiers) flushDue(ctx context.Context) {
+	for _, classifier := range rcs.all() {
+		classifier.mu.Lock()
+		var err error
+		if classifier.flushDue(classifier.clock.Now()) {
+			err = classifier.flush(ctx)
+		}
+		classifier.mu.Unlock()
+
+		if err != nil {
+			rcs.getLogger().WarnContext(ctx, "failed to flush classifier", slog.Any("error", err))
+		}
+	}
+}
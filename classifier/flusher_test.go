@@ -0,0 +1,160 @@
+package classifier
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/robobo1221/afostoClassifier/database"
+)
+
+// classifyN classifies n successful responses between 10 and 50 milliseconds with rc.
+func classifyN(rc *ResponseClassifier, n int) {
+	for i := 0; i < n; i++ {
+		rc.SetResponse(time.Duration(10+i%40)*time.Millisecond, 200, -1)
+		rc.Classify(context.Background())
+	}
+}
+
+func TestDebouncedWritesCoalesceWithinInterval(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	rc, err := NewResponseClassifier(t.Name(), 1, false, 10000, 0, WithDebouncedWrites(time.Minute, 0), WithClock(clock))
+	if err != nil {
+		t.Fatalf("NewResponseClassifier() error = %v", err)
+	}
+
+	classifyN(rc, 10)
+	if got := storedCount(t, t.Name()); got != -1 {
+		t.Fatalf("stored count within the interval = %d, want nothing stored", got)
+	}
+
+	// The first response after the interval writes every observation held in memory at once
+	clock.advance(time.Minute)
+	classifyN(rc, 1)
+	if got := storedCount(t, t.Name()); got != 11 {
+		t.Fatalf("stored count after the interval = %d, want 11", got)
+	}
+
+	classifyN(rc, 5)
+	if got := storedCount(t, t.Name()); got != 11 {
+		t.Errorf("stored count within the next interval = %d, want 11", got)
+	}
+}
+
+func TestDebouncedWritesFlushEveryNObservations(t *testing.T) {
+	rc, err := NewResponseClassifier(t.Name(), 1, false, 10000, 0, WithDebouncedWrites(0, 100))
+	if err != nil {
+		t.Fatalf("NewResponseClassifier() error = %v", err)
+	}
+
+	flushes, last := 0, -1
+	for i := 1; i <= 1000; i++ {
+		classifyN(rc, 1)
+
+		got := storedCount(t, t.Name())
+		if got == last {
+			continue
+		}
+		if got != i || i%100 != 0 {
+			t.Fatalf("stored count after %d observations = %d, want a flush every 100 observations", i, got)
+		}
+		flushes, last = flushes+1, got
+	}
+
+	if flushes != 10 {
+		t.Errorf("flushes = %d, want 10", flushes)
+	}
+}
+
+func TestFlushPersistsDebouncedWindows(t *testing.T) {
+	rcs := NewResponseClassifiers()
+
+	// Windows of 50 swap twice, so the flush also has to persist the swapped out window
+	cfg := testConfig()
+	cfg.WindowSize = 50
+	debounced := cfg
+	debounced.Options = []ResponseClassifierOption{WithDebouncedWrites(time.Hour, 0)}
+
+	for i := 0; i < 137; i++ {
+		responseTime := time.Duration(10+i%40) * time.Millisecond
+		if _, err := rcs.DispatchWithConfig(context.Background(), t.Name()+"-direct", cfg, responseTime, 200, -1); err != nil {
+			t.Fatalf("DispatchWithConfig() error = %v", err)
+		}
+		if _, err := rcs.DispatchWithConfig(context.Background(), t.Name()+"-debounced", debounced, responseTime, 200, -1); err != nil {
+			t.Fatalf("DispatchWithConfig() error = %v", err)
+		}
+	}
+
+	if got := storedCount(t, t.Name()+"-debounced"); got != -1 {
+		t.Fatalf("stored count before Flush() = %d, want nothing stored", got)
+	}
+
+	if err := rcs.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	want, err := database.GetPsqrFromConnection(context.Background(), t.Name()+"-direct", defaultPercentile)
+	if err != nil {
+		t.Fatalf("GetPsqrFromConnection() error = %v", err)
+	}
+	got, err := database.GetPsqrFromConnection(context.Background(), t.Name()+"-debounced", defaultPercentile)
+	if err != nil {
+		t.Fatalf("GetPsqrFromConnection() of the flushed classifier error = %v", err)
+	}
+
+	if got.Count != want.Count || got.Q != want.Q || got.N != want.N || got.Np != want.Np {
+		t.Errorf("flushed window = %+v, want %+v", got, want)
+	}
+	if (got.PreviousID == nil) != (want.PreviousID == nil) {
+		t.Errorf("flushed window has a previous window %v, want %v", got.PreviousID != nil, want.PreviousID != nil)
+	}
+
+	// Nothing changed since, a second flush writes nothing and doesn't fail
+	if err := rcs.Flush(context.Background()); err != nil {
+		t.Errorf("second Flush() error = %v", err)
+	}
+}
+
+func TestStartFlusherPersistsDueClassifiers(t *testing.T) {
+	rcs := NewResponseClassifiers()
+	rcs.SetDebouncedWrites(time.Minute, 0)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	rcs.SetClock(clock)
+
+	for i := 0; i < 10; i++ {
+		if _, err := rcs.DispatchWithConfig(context.Background(), t.Name(), testConfig(), 10*time.Millisecond, 200, -1); err != nil {
+			t.Fatalf("DispatchWithConfig() error = %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := rcs.StartFlusher(ctx, time.Millisecond); err != nil {
+		t.Fatalf("StartFlusher() error = %v", err)
+	}
+
+	// Nothing is due before the debounce interval has passed
+	time.Sleep(20 * time.Millisecond)
+	if got := storedCount(t, t.Name()); got != -1 {
+		t.Fatalf("stored count before the interval passed = %d, want nothing stored", got)
+	}
+
+	clock.advance(2 * time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for storedCount(t, t.Name()) != 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stored count after the interval passed = %d, want 10", storedCount(t, t.Name()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStartFlusherRejectsNonPositiveInterval(t *testing.T) {
+	rcs := NewResponseClassifiers()
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := rcs.StartFlusher(context.Background(), interval); err == nil {
+			t.Errorf("StartFlusher() with interval %s succeeded, want an error", interval)
+		}
+	}
+}
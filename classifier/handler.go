@@ -0,0 +1,81 @@
+package classifier
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+// statusRecorder wraps a ResponseWriter to capture the status code and the number of bytes written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	code    int
+	size    int
+	written bool
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if !w.written {
+		w.code = code
+		w.written = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if !w.written {
+		// Writing the body without a status implies 200, like the ResponseWriter it wraps
+		w.code = http.StatusOK
+		w.written = true
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.size += n
+	return n, err
+}
+
+// Flush passes flushes on to the wrapped ResponseWriter when it supports them, so streaming handlers keep working.
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.written {
+			w.code = http.StatusOK
+			w.written = true
+		}
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ClassifyHandler wraps a handler to classify its own latency, the server side counterpart of the round tripper.
+// Each route is classified separately, keyed as "METHOD route" with the route derived by DefaultRouteExtractor,
+// and every classifier is created with cfg. A handler that doesn't write a status is counted as 200.
+// The classification happens in the background after the handler returns, so it doesn't delay the response.
+// The latency is measured with the clock of the classifiers, see SetClock.
+func ClassifyHandler(h http.Handler, classifiers *ResponseClassifiers, cfg ClassifierConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+
+		clock := classifiers.getClock()
+		start := clock.Now()
+		h.ServeHTTP(recorder, r)
+		respTime := clock.Now().Sub(start)
+
+		method := r.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		connection := method + " " + DefaultRouteExtractor(r)
+		response := NewResponse(respTime, recorder.code, recorder.size)
+
+		// The request context is cancelled as soon as the handler returns, which would skip the classification
+		ctx := context.WithoutCancel(r.Context())
+		go func() {
+			if _, _, err := classifiers.dispatch(ctx, connection, cfg, response); err != nil {
+				classifiers.getLogger().WarnContext(ctx, "failed to classify response", slog.String("connection", connection), slog.Any("error", err))
+			}
+		}()
+	})
+}
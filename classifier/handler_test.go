@@ -0,0 +1,69 @@
+package classifier
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestClassifyHandlerClassifiesRoutes(t *testing.T) {
+	rcs := NewResponseClassifiers()
+	rcs.SetObserveOnly(true)
+
+	const delay = 5 * time.Millisecond
+	handler := ClassifyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	}), rcs, testConfig())
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	send := func(method string, path string) {
+		t.Helper()
+
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest() error = %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s error = %v", method, path, err)
+		}
+		resp.Body.Close()
+	}
+	for i := 1; i <= 3; i++ {
+		send(http.MethodGet, "/items/"+strconv.Itoa(i))
+	}
+	send(http.MethodDelete, "/items/1")
+
+	// Every item shares the route, each method is classified separately
+	classifier := waitClassified(t, rcs, "GET /items/:id", 3)
+	response := classifier.GetResponse()
+	if response.GetTime() < delay || response.GetCode() != http.StatusOK || response.GetSize() != 2 {
+		t.Errorf("classified response = %s, %d, %d bytes, want at least %s, 200 and 2 bytes", response.GetTime(), response.GetCode(), response.GetSize(), delay)
+	}
+	if score := classifier.GetScore(); score <= 0 || score > 1 {
+		t.Errorf("score of similar responses = %v, want within (0,1]", score)
+	}
+
+	// Failures don't add samples, wait for the status instead
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if classifier, ok := rcs.Get("DELETE /items/:id"); ok {
+			if response := classifier.GetResponse(); response.GetCode() == http.StatusServiceUnavailable {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the failed DELETE wasn't classified with its status within 5s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,69 @@
+package classifier
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/robobo1221/afostoClassifier/database"
+)
+
+// SetScoreHistoryInterval makes RecordMetrics persist the score of a connection at most once per interval,
+// so GetScoreHistory can chart it over time without a row per request. 0 or less disables the history, which is the default.
+// Classifiers in observe-only mode never persist their score.
+func (rcs *ResponseClassifiers) SetScoreHistoryInterval(interval time.Duration) {
+	rcs.mu.Lock()
+	defer rcs.mu.Unlock()
+
+	rcs.scoreHistoryInterval = interval
+}
+
+func (rcs *ResponseClassifiers) getScoreHistoryInterval() time.Duration {
+	rcs.mu.RLock()
+	defer rcs.mu.RUnlock()
+
+	return rcs.scoreHistoryInterval
+}
+
+// GetScoreHistory returns the persisted scores of a connection recorded at or after since, oldest first.
+func (rcs *ResponseClassifiers) GetScoreHistory(connection string, since time.Time) ([]database.ScorePoint, error) {
+	return database.GetScoreHistory(context.Background(), connection, since)
+}
+
+// StartScoreHistoryPruner deletes the persisted scores older than retention, checking every interval,
+// until ctx is cancelled. It returns an error without starting when retention or interval isn't positive.
+func (rcs *ResponseClassifiers) StartScoreHistoryPruner(ctx context.Context, retention time.Duration, interval time.Duration) error {
+	if retention <= 0 || interval <= 0 {
+		return fmt.Errorf("invalid score history retention %s or interval %s: must be greater than 0", retention, interval)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := database.PruneScoreHistory(ctx, rcs.getClock().Now().Add(-retention)); err != nil {
+					rcs.getLogger().WarnContext(ctx, "failed to prune score history", slog.Any("error", err))
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// scoreHistoryDue reports whether the score of the classifier should be persisted at now, given the history
+// interval, and if so marks it as persisted. The caller must hold rc.mu.
+func (rc *ResponseClassifier) scoreHistoryDue(now time.Time, interval time.Duration) bool {
+	if interval <= 0 || rc.observeOnly || now.Sub(rc.lastHistoryWrite) < interval {
+		return false
+	}
+
+	rc.lastHistoryWrite = now
+	return true
+}
@@ -0,0 +1,65 @@
+package classifier
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/robobo1221/afostoClassifier/database"
+)
+
+func TestScoreHistoryPrunerDeletesScoresOlderThanRetention(t *testing.T) {
+	rcs := NewResponseClassifiers()
+	clock := &fakeClock{now: time.Unix(1_000_000, 0)}
+	rcs.SetClock(clock)
+
+	old := clock.Now().Add(-2 * time.Hour)
+	recent := clock.Now().Add(-30 * time.Minute)
+	for _, at := range []time.Time{old, recent} {
+		if err := database.InsertScore(context.Background(), t.Name(), at, 0.5); err != nil {
+			t.Fatalf("InsertScore() error = %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := rcs.StartScoreHistoryPruner(ctx, time.Hour, time.Millisecond); err != nil {
+		t.Fatalf("StartScoreHistoryPruner() error = %v", err)
+	}
+
+	// The cutoff follows the clock of the classifiers, not the wall clock
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		points, err := rcs.GetScoreHistory(t.Name(), time.Time{})
+		if err != nil {
+			t.Fatalf("GetScoreHistory() error = %v", err)
+		}
+		if len(points) == 1 {
+			if !points[0].Time.Equal(recent) {
+				t.Errorf("remaining score recorded at %s, want %s", points[0].Time, recent)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("score history after pruning = %v, want only the score recorded at %s", points, recent)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestScoreHistoryPrunerRejectsNonPositiveDurations(t *testing.T) {
+	rcs := NewResponseClassifiers()
+
+	for _, tt := range []struct {
+		retention, interval time.Duration
+	}{
+		{retention: 0, interval: time.Hour},
+		{retention: -time.Hour, interval: time.Hour},
+		{retention: time.Hour, interval: 0},
+		{retention: time.Hour, interval: -time.Hour},
+	} {
+		if err := rcs.StartScoreHistoryPruner(context.Background(), tt.retention, tt.interval); err == nil {
+			t.Errorf("StartScoreHistoryPruner() with retention %s and interval %s succeeded, want an error", tt.retention, tt.interval)
+		}
+	}
+}
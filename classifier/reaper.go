@@ -0,0 +1,75 @@
+package classifier
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// StartReaper evicts classifiers that haven't classified a response within idleTTL, checking every interval,
+// until ctx is cancelled. Every classification already persists its PSQR, and debounced writes are flushed
+// before evicting, so an evicted connection continues from its stored estimate when it is seen again.
+// It returns an error without starting when idleTTL or interval isn't positive.
+func (rcs *ResponseClassifiers) StartReaper(ctx context.Context, idleTTL time.Duration, interval time.Duration) error {
+	if idleTTL <= 0 || interval <= 0 {
+		return fmt.Errorf("invalid reaper idle TTL %s or interval %s: must be greater than 0", idleTTL, interval)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				rcs.evictIdle(ctx, rcs.getClock().Now().Add(-idleTTL))
+			}
+		}
+	}()
+
+	return nil
+}
+
+// evictIdle evicts the classifiers last seen before cutoff. The classifiers are flushed without holding rcs.mu,
+// so persisting them doesn't block the other connections.
+func (rcs *ResponseClassifiers) evictIdle(ctx context.Context, cutoff time.Time) {
+	for _, classifier := range rcs.all() {
+		classifier.mu.Lock()
+		idle := classifier.lastSeen.Before(cutoff)
+		var err error
+		if idle {
+			err = classifier.flush(ctx)
+		}
+		classifier.mu.Unlock()
+
+		// Keep a classifier whose windows couldn't be persisted, the next check tries again
+		if err != nil {
+			rcs.getLogger().WarnContext(ctx, "failed to flush idle classifier", slog.Any("error", err))
+			continue
+		}
+
+		if idle {
+			rcs.evict(classifier, cutoff)
+		}
+	}
+}
+
+// evict removes a flushed classifier, unless it was replaced or classified a response since it was flushed.
+func (rcs *ResponseClassifiers) evict(classifier *ResponseClassifier, cutoff time.Time) {
+	rcs.mu.Lock()
+	defer rcs.mu.Unlock()
+
+	if rcs.classifiers[classifier.connectionName] != classifier {
+		return
+	}
+
+	classifier.mu.Lock()
+	defer classifier.mu.Unlock()
+
+	if classifier.lastSeen.Before(cutoff) {
+		delete(rcs.classifiers, classifier.connectionName)
+	}
+}
@@ -0,0 +1,78 @@
+package classifier
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReaperEvictsIdleClassifiers(t *testing.T) {
+	rcs := NewResponseClassifiers()
+	rcs.SetDebouncedWrites(time.Hour, 0)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	rcs.SetClock(clock)
+
+	idle := t.Name() + "/idle"
+	active := t.Name() + "/active"
+	dispatch := func(connection string, n int) {
+		t.Helper()
+
+		for i := 0; i < n; i++ {
+			if _, err := rcs.DispatchWithConfig(context.Background(), connection, testConfig(), 10*time.Millisecond, 200, -1); err != nil {
+				t.Fatalf("DispatchWithConfig() error = %v", err)
+			}
+		}
+	}
+
+	dispatch(idle, 10)
+	dispatch(active, 10)
+	if got := storedCount(t, idle); got != -1 {
+		t.Fatalf("stored count of the idle connection before evicting = %d, want nothing stored yet", got)
+	}
+
+	clock.advance(2 * time.Minute)
+	dispatch(active, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := rcs.StartReaper(ctx, time.Minute, time.Millisecond); err != nil {
+		t.Fatalf("StartReaper() error = %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := rcs.Get(idle); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("idle classifier %s was never evicted", idle)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, ok := rcs.Get(active); !ok {
+		t.Errorf("active classifier %s was evicted", active)
+	}
+
+	// The debounced windows of the idle classifier were flushed before evicting it
+	if got := storedCount(t, idle); got != 10 {
+		t.Errorf("stored count of the evicted connection = %d, want 10", got)
+	}
+}
+
+func TestReaperRejectsNonPositiveDurations(t *testing.T) {
+	rcs := NewResponseClassifiers()
+
+	for _, tt := range []struct {
+		idleTTL, interval time.Duration
+	}{
+		{idleTTL: 0, interval: time.Second},
+		{idleTTL: -time.Minute, interval: time.Second},
+		{idleTTL: time.Minute, interval: 0},
+		{idleTTL: time.Minute, interval: -time.Second},
+	} {
+		if err := rcs.StartReaper(context.Background(), tt.idleTTL, tt.interval); err == nil {
+			t.Errorf("StartReaper() with idle TTL %s and interval %s succeeded, want an error", tt.idleTTL, tt.interval)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package classifier
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RouteExtractor derives the route of a request, so each route of a host is classified separately.
+type RouteExtractor func(*http.Request) string
+
+// idSegment matches path segments that identify a resource rather than a route: numbers and UUIDs.
+var idSegment = regexp.MustCompile(`^(\d+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})$`)
+
+// DefaultRouteExtractor returns the path of the request with numeric and UUID segments replaced by ":id",
+// so /users/1 and /users/2 share the route /users/:id and the number of classifiers stays bounded.
+func DefaultRouteExtractor(req *http.Request) string {
+	segments := strings.Split(req.URL.Path, "/")
+	for i, segment := range segments {
+		if idSegment.MatchString(segment) {
+			segments[i] = ":id"
+		}
+	}
+
+	route := strings.Join(segments, "/")
+	if route == "" {
+		route = "/"
+	}
+
+	return route
+}
+
+// WithRouteExtractor classifies every route of a host separately, keyed as "host route".
+// By default all routes of a host share a single classifier. The configuration is still resolved per host.
+func WithRouteExtractor(extractor RouteExtractor) RoundTripperOption {
+	return func(t *ClassifierRoundTripper) {
+		t.routeExtractor = extractor
+	}
+}
+
+// WithMethodInKey classifies each request method of a host separately, keyed as "METHOD host", or
+// "METHOD host route" together with WithRouteExtractor. A write is naturally slower than a cacheable read,
+// mixing them distorts the distribution of both. Existing connections are stored under keys without the
+// method, so enabling it starts every connection from scratch.
+func WithMethodInKey(methodInKey bool) RoundTripperOption {
+	return func(t *ClassifierRoundTripper) {
+		t.methodInKey = methodInKey
+	}
+}
+
+// connectionKey returns the host of a request and the key of the classifier its response is classified by.
+func (t *ClassifierRoundTripper) connectionKey(req *http.Request) (string, string) {
+	host := t.classifiers.connectionName(req)
+
+	key := host
+	if t.methodInKey {
+		method := req.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		key = method + " " + key
+	}
+	if t.routeExtractor != nil {
+		key += " " + t.routeExtractor(req)
+	}
+
+	return host, key
+}
@@ -0,0 +1,107 @@
+package classifier
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultRouteExtractor(t *testing.T) {
+	for _, tt := range []struct {
+		url, want string
+	}{
+		{url: "http://example.com", want: "/"},
+		{url: "http://example.com/", want: "/"},
+		{url: "http://example.com/users/1", want: "/users/:id"},
+		{url: "http://example.com/users/2/orders/3", want: "/users/:id/orders/:id"},
+		{url: "http://example.com/users/5f0c7a2e-4b1d-4c8e-9a3f-1d2e3f4a5b6c", want: "/users/:id"},
+		{url: "http://example.com/users/me", want: "/users/me"},
+		{url: "http://example.com/v2/search?q=1", want: "/v2/search"},
+	} {
+		req, err := http.NewRequest(http.MethodGet, tt.url, nil)
+		if err != nil {
+			t.Fatalf("NewRequest(%s) error = %v", tt.url, err)
+		}
+		if got := DefaultRouteExtractor(req); got != tt.want {
+			t.Errorf("DefaultRouteExtractor(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestRouteExtractorKeysClassifiers(t *testing.T) {
+	rcs := NewResponseClassifiers()
+	rcs.SetObserveOnly(true)
+	transport := NewClassifierRoundTripper(rcs, WithRouteExtractor(DefaultRouteExtractor)).(*ClassifierRoundTripper)
+
+	key := func(url string) string {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatalf("NewRequest(%s) error = %v", url, err)
+		}
+		host, key := transport.connectionKey(req)
+		if host != "example.com" {
+			t.Errorf("host of %s = %q, want example.com", url, host)
+		}
+		return key
+	}
+
+	users1, users2, orders1 := key("http://example.com/users/1"), key("http://example.com/users/2"), key("http://example.com/orders/1")
+	if users1 != "example.com /users/:id" || users2 != users1 {
+		t.Errorf("keys of /users/1 and /users/2 = %q and %q, want both example.com /users/:id", users1, users2)
+	}
+	if orders1 == users1 {
+		t.Errorf("key of /orders/1 = %q, want it to differ from /users/1", orders1)
+	}
+
+	// Without an extractor every route of a host shares its classifier
+	transport = NewClassifierRoundTripper(rcs).(*ClassifierRoundTripper)
+	if got := key("http://example.com/orders/1"); got != "example.com" {
+		t.Errorf("key without a route extractor = %q, want example.com", got)
+	}
+}
+
+func TestMethodInKeySeparatesMethods(t *testing.T) {
+	rcs := NewResponseClassifiers()
+	rcs.SetObserveOnly(true)
+
+	// Writes are slower than reads
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodPost {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok")), ContentLength: 2, Request: req}, nil
+	})
+	client := &http.Client{Transport: NewClassifierRoundTripperWithTransport(rcs, base, WithMethodInKey(true))}
+
+	send := func(method string) {
+		t.Helper()
+
+		req, err := http.NewRequest(method, "http://example.com/orders", nil)
+		if err != nil {
+			t.Fatalf("NewRequest() error = %v", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s error = %v", method, err)
+		}
+		resp.Body.Close()
+	}
+	for i := 0; i < 3; i++ {
+		send(http.MethodGet)
+		send(http.MethodPost)
+	}
+	send(http.MethodGet)
+
+	get := waitClassified(t, rcs, "GET example.com", 4)
+	post := waitClassified(t, rcs, "POST example.com", 3)
+	if _, ok := rcs.Get("example.com"); ok {
+		t.Error("a classifier keyed without the method exists")
+	}
+	if get.LastP90() >= post.LastP90() {
+		t.Errorf("GET percentile = %v, POST percentile = %v, want each scored against its own responses", get.LastP90(), post.LastP90())
+	}
+}
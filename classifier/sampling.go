@@ -0,0 +1,67 @@
+package classifier
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// WithSampleRate classifies only the given fraction of the responses, between 0 and 1, to reduce the overhead
+// of classifying and persisting every response at a high request rate. A classified response counts as
+// 1/rate responses in the PSQR window on average, so the estimate keeps its pace. The response time and
+// request count metrics are still recorded for every response. Rates outside of [0, 1] are clamped, the
+// default is 1.
+func WithSampleRate(rate float64) RoundTripperOption {
+	return func(t *ClassifierRoundTripper) {
+		t.sampleRate = math.Min(math.Max(rate, 0.0), 1.0)
+	}
+}
+
+// sample decides whether a response is classified and returns the number of responses it stands for if so.
+// Weights are whole responses, so when 1/rate isn't whole it is rounded up or down at random in proportion
+// to its fraction. A rate of 0.4 gives weights of 2 and 3 averaging 2.5, where always rounding would count
+// every sampled response as 3 and overstate the traffic by a fifth.
+func (t *ClassifierRoundTripper) sample() (int, bool) {
+	if t.sampleRate >= 1 {
+		return 1, true
+	}
+	if rand.Float64() >= t.sampleRate {
+		return 0, false
+	}
+
+	whole, fraction := math.Modf(1 / t.sampleRate)
+	weight := int(whole)
+	if rand.Float64() < fraction {
+		weight++
+	}
+
+	return weight, true
+}
+
+// recordUnclassified records the response time and request count of a response that isn't classified,
+// because it wasn't sampled. The breaker state is omitted while the connection has no classifier yet.
+func (rcs *ResponseClassifiers) recordUnclassified(ctx context.Context, connection string, response Response) {
+	metrics := rcs.CurrentOtelMetrics
+	if metrics == nil {
+		return
+	}
+
+	attrs := []attribute.KeyValue{
+		attribute.String("connection_name", connection),
+		metrics.statusAttribute(response.code),
+	}
+	if rc, ok := rcs.Get(connection); ok {
+		attrs = append(attrs, attribute.String("breaker_state", rc.State()))
+	}
+
+	if metrics.ResponseTime != nil {
+		metrics.ResponseTime.Record(ctx, float64(response.time)/float64(time.Millisecond), metric.WithAttributes(attrs...))
+	}
+	if metrics.TotalRequests != nil {
+		metrics.TotalRequests.Add(ctx, 1, metric.WithAttributes(attrs...))
+	}
+}
@@ -0,0 +1,86 @@
+package classifier
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestSampleRateDecidesClassification(t *testing.T) {
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok")), ContentLength: 2, Request: req}, nil
+	})
+
+	for _, tt := range []struct {
+		rate float64
+		want int
+	}{
+		{rate: 0, want: 0},
+		{rate: 1, want: 20},
+	} {
+		reader := useManualReader(t)
+		rcs := NewResponseClassifiers()
+		rcs.SetObserveOnly(true)
+		client := &http.Client{Transport: NewClassifierRoundTripperWithTransport(rcs, base, WithSampleRate(tt.rate))}
+
+		for i := 0; i < 20; i++ {
+			resp, err := client.Get("http://sampled.test/")
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			resp.Body.Close()
+		}
+
+		if tt.want == 0 {
+			if _, ok := rcs.Get("sampled.test"); ok {
+				t.Errorf("rate %v: a classifier was created", tt.rate)
+			}
+		} else {
+			waitClassified(t, rcs, "sampled.test", tt.want)
+		}
+
+		// Every request is counted, sampled or not, in the background like the classification
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			requests, _ := collectMetric(t, reader, "http_total_requests").(metricdata.Sum[int64])
+			var total int64
+			for _, point := range requests.DataPoints {
+				total += point.Value
+			}
+			if total == 20 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("rate %v: http_total_requests = %d after 5s, want 20", tt.rate, total)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestSampleWeightIsUnbiased(t *testing.T) {
+	for _, rate := range []float64{0.4, 0.3, 0.25} {
+		transport := NewClassifierRoundTripper(NewResponseClassifiers(), WithSampleRate(rate)).(*ClassifierRoundTripper)
+
+		var sampled, weights int
+		for i := 0; i < 200000; i++ {
+			if weight, ok := transport.sample(); ok {
+				sampled++
+				weights += weight
+			}
+		}
+
+		// The sampled responses stand for all of them
+		if mean := float64(weights) / float64(sampled); math.Abs(mean-1/rate) > 0.02 {
+			t.Errorf("rate %v: mean weight = %v, want %v", rate, mean, 1/rate)
+		}
+		if math.Abs(float64(weights)/200000-1) > 0.02 {
+			t.Errorf("rate %v: weights sum to %d for 200000 responses", rate, weights)
+		}
+	}
+}
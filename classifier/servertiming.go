@@ -0,0 +1,49 @@
+package classifier
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WithServerTiming classifies responses on the duration the upstream reports for the named metric in its
+// Server-Timing header, for instance "app" for "Server-Timing: app;dur=42.0". The reported duration excludes
+// the network, so jitter on the way doesn't pollute the estimate. Responses without the metric or its dur
+// parameter fall back to the measured time. An empty name disables it, which is the default.
+func WithServerTiming(metricName string) RoundTripperOption {
+	return func(t *ClassifierRoundTripper) {
+		t.serverTimingMetric = metricName
+	}
+}
+
+// serverTiming returns the duration of the named metric in the Server-Timing headers, if it is reported.
+// Every header may list several metrics separated by commas, each followed by parameters separated by semicolons.
+func serverTiming(header http.Header, metricName string) (time.Duration, bool) {
+	for _, value := range header.Values("Server-Timing") {
+		for _, entry := range strings.Split(value, ",") {
+			params := strings.Split(entry, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), metricName) {
+				continue
+			}
+
+			for _, param := range params[1:] {
+				key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(key), "dur") {
+					continue
+				}
+
+				ms, err := strconv.ParseFloat(strings.Trim(strings.TrimSpace(val), `"`), 64)
+				if err != nil || ms < 0 {
+					return 0, false
+				}
+
+				return time.Duration(ms * float64(time.Millisecond)), true
+			}
+
+			return 0, false
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,67 @@
+package classifier
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServerTimingParsesNamedMetric(t *testing.T) {
+	for _, tt := range []struct {
+		values []string
+		want   time.Duration
+		ok     bool
+	}{
+		{values: []string{"app;dur=42.0"}, want: 42 * time.Millisecond, ok: true},
+		{values: []string{`db;dur=3, app;desc="render";dur="1.5"`}, want: 1500 * time.Microsecond, ok: true},
+		{values: []string{"db;dur=3", "APP; dur = 7"}, want: 7 * time.Millisecond, ok: true},
+		{values: []string{"db;dur=3"}},
+		{values: []string{"app"}},
+		{values: []string{"app;dur=-1"}},
+		{values: []string{"app;dur=fast"}},
+		{},
+	} {
+		header := http.Header{}
+		for _, value := range tt.values {
+			header.Add("Server-Timing", value)
+		}
+
+		got, ok := serverTiming(header, "app")
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("serverTiming(%q) = %v, %v, want %v, %v", tt.values, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRoundTripUsesServerTiming(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/timed" {
+			w.Header().Set("Server-Timing", "app;dur=42.0")
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	rcs := NewResponseClassifiers()
+	rcs.SetObserveOnly(true)
+	rcs.SetNameNormalizer(func(r *http.Request) string { return r.URL.Path })
+	client := &http.Client{Transport: NewClassifierRoundTripper(rcs, WithServerTiming("app"))}
+
+	for _, path := range []string{"/timed", "/timed", "/untimed", "/untimed"} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Get(%s) error = %v", path, err)
+		}
+		resp.Body.Close()
+	}
+
+	// The second response is scored against the exact time of the first
+	if got := waitClassified(t, rcs, "/timed", 2).LastP90(); got != 42 {
+		t.Errorf("LastP90() with Server-Timing = %v, want the reported 42ms", got)
+	}
+	if got := waitClassified(t, rcs, "/untimed", 2).LastP90(); got >= 42 {
+		t.Errorf("LastP90() without Server-Timing = %v, want the measured time of a local round trip", got)
+	}
+}
@@ -0,0 +1,65 @@
+package classifier
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// WithSLO scores a connection on its compliance with a latency SLO such as "99% of requests under 300ms",
+// given as threshold 300ms and fraction 0.99, instead of relative to its own percentile estimate.
+// The compliance is the fraction of roughly the last window size of responses at or below threshold. The score
+// is 1 at full compliance, 0.5 when the compliance equals fraction and the error budget is exactly spent, and 0
+// once twice the budget is spent. Error responses are still penalized as configured with WithErrorPenalties.
+// The compliance is kept in memory only, so it starts over when the classifier is recreated.
+func WithSLO(threshold time.Duration, fraction float64) ResponseClassifierOption {
+	return func(rc *ResponseClassifier) {
+		rc.sloThreshold = threshold
+		rc.sloFraction = fraction
+	}
+}
+
+// validateSLO returns an error when the SLO set with WithSLO can't be scored against.
+func (rc *ResponseClassifier) validateSLO() error {
+	if rc.sloThreshold == 0 && rc.sloFraction == 0 {
+		return nil
+	}
+
+	if rc.sloThreshold <= 0 {
+		return fmt.Errorf("invalid SLO threshold %s for connection %s: must be greater than 0", rc.sloThreshold, rc.connectionName)
+	}
+	if !(rc.sloFraction > 0 && rc.sloFraction <= 1) {
+		return fmt.Errorf("invalid SLO fraction %v for connection %s: must be greater than 0 and at most 1", rc.sloFraction, rc.connectionName)
+	}
+
+	return nil
+}
+
+// updateSLOCompliance adds a response to the compliance and returns the updated compliance.
+// The compliance is the exact fraction of the responses seen so far until a window's worth of responses
+// has been seen, after that older responses fade out exponentially.
+func (rc *ResponseClassifier) updateSLOCompliance(response *Response) float64 {
+	met := 0.0
+	if rc.normalizedTime(response) <= int(rc.sloThreshold.Milliseconds()) {
+		met = 1.0
+	}
+
+	rc.sloSamples = min(rc.sloSamples+1, rc.windowSize)
+	rc.sloCompliance += (met - rc.sloCompliance) / float64(rc.sloSamples)
+
+	return rc.sloCompliance
+}
+
+// sloScore maps a compliance to a score through the share of the error budget that is spent.
+func (rc *ResponseClassifier) sloScore(compliance float64) float64 {
+	budget := 1.0 - rc.sloFraction
+	if budget <= 0 {
+		if compliance >= 1 {
+			return 1.0
+		}
+		return 0.0
+	}
+
+	spent := (1.0 - compliance) / budget
+	return math.Min(math.Max(1.0-0.5*spent, 0), 1)
+}
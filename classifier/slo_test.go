@@ -0,0 +1,60 @@
+package classifier
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSLOScoreFromConfig(t *testing.T) {
+	rcs := NewResponseClassifiers()
+
+	cfg := testConfig()
+	cfg.Options = []ResponseClassifierOption{WithSLO(300*time.Millisecond, 0.99)}
+
+	for _, tt := range []struct {
+		name   string
+		period int // Every period-th response misses the SLO, 0 for none
+		want   float64
+	}{
+		{name: "compliant", period: 0, want: 1},
+		{name: "half budget", period: 200, want: 0.75},
+		{name: "budget spent", period: 100, want: 0.5},
+		{name: "95% under threshold", period: 20, want: 0},
+	} {
+		var classifier *ResponseClassifier
+		for i := 0; i < 400; i++ {
+			responseTime := 100 * time.Millisecond
+			if tt.period > 0 && i%tt.period == 0 {
+				responseTime = time.Second
+			}
+
+			var err error
+			classifier, err = rcs.DispatchWithConfig(context.Background(), t.Name()+"-"+tt.name, cfg, responseTime, 200, -1)
+			if err != nil {
+				t.Fatalf("DispatchWithConfig() error = %v", err)
+			}
+		}
+
+		verdict := classifier.Verdict()
+		if math.Abs(verdict.Score-tt.want) > 0.01 {
+			t.Errorf("%s: score = %v, want %v", tt.name, verdict.Score, tt.want)
+		}
+		if verdict.UpperLimit != 300 {
+			t.Errorf("%s: upper limit = %v, want the SLO threshold of 300", tt.name, verdict.UpperLimit)
+		}
+	}
+}
+
+func TestSLOIsValidated(t *testing.T) {
+	for _, opt := range []ResponseClassifierOption{
+		WithSLO(0, 0.99),
+		WithSLO(300*time.Millisecond, 0),
+		WithSLO(300*time.Millisecond, 1.5),
+	} {
+		if _, err := NewResponseClassifier(t.Name(), 1, false, 100, 0, opt); err == nil {
+			t.Error("NewResponseClassifier() with an invalid SLO succeeded, want an error")
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package database
+
+import "errors"
+
+// Errors returned by the functions of this package, wrapped with context, to be matched with errors.Is.
+var (
+	// ErrPsqrNotFound is returned when a PSQR doesn't exist, for instance because a connection has no PSQR for a
+	// percentile yet.
+	ErrPsqrNotFound = errors.New("PSQR not found")
+
+	// ErrConnectionNotFound is returned when a connection has no stored data at all, for instance when renaming it.
+	ErrConnectionNotFound = errors.New("connection not found")
+
+	// ErrConnectionExists is returned when a connection is renamed to the name of a connection that already exists.
+	ErrConnectionExists = errors.New("connection already exists")
+
+	// ErrBusy is returned when the database is still busy or locked by another connection after retrying.
+	ErrBusy = errors.New("database busy")
+)
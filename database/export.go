@@ -0,0 +1,323 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+)
+
+// Formats supported by ExportState.
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// stateColumns is the header of a CSV export, in the order the values of a PsqrState are written.
+var stateColumns = []string{
+	"connection", "perc", "count",
+	"q0", "q1", "q2", "q3", "q4",
+	"n0", "n1", "n2", "n3", "n4",
+	"np0", "np1", "np2", "np3", "np4",
+	"dn0", "dn1", "dn2", "dn3", "dn4",
+}
+
+// PsqrState is the current PSQR of a connection for one percentile, as written by ExportState.
+type PsqrState struct {
+	Connection string     `json:"connection"`
+	Perc       float64    `json:"perc"`
+	Count      int        `json:"count"`
+	Q          [5]float64 `json:"q"`
+	N          [5]int     `json:"n"`
+	Np         [5]float64 `json:"np"`
+	Dn         [5]float64 `json:"dn"`
+}
+
+// record returns the values of the state in the order of stateColumns. Floats are formatted with the
+// fewest digits that parse back to the same value, so an export loses no precision.
+func (s PsqrState) record() []string {
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+
+	record := make([]string, 0, len(stateColumns))
+	record = append(record, s.Connection, formatFloat(s.Perc), strconv.Itoa(s.Count))
+	for _, q := range s.Q {
+		record = append(record, formatFloat(q))
+	}
+	for _, n := range s.N {
+		record = append(record, strconv.Itoa(n))
+	}
+	for _, np := range s.Np {
+		record = append(record, formatFloat(np))
+	}
+	for _, dn := range s.Dn {
+		record = append(record, formatFloat(dn))
+	}
+
+	return record
+}
+
+// parseRecord parses the values of a CSV row in the order of stateColumns.
+func parseRecord(record []string) (PsqrState, error) {
+	var state PsqrState
+	var err error
+
+	parseFloat := func(i int) float64 {
+		if err != nil {
+			return 0
+		}
+		var f float64
+		if f, err = strconv.ParseFloat(record[i], 64); err != nil {
+			err = fmt.Errorf("invalid %s %q: %w", stateColumns[i], record[i], err)
+		}
+		return f
+	}
+	parseInt := func(i int) int {
+		if err != nil {
+			return 0
+		}
+		var n int
+		if n, err = strconv.Atoi(record[i]); err != nil {
+			err = fmt.Errorf("invalid %s %q: %w", stateColumns[i], record[i], err)
+		}
+		return n
+	}
+
+	state.Connection = record[0]
+	state.Perc = parseFloat(1)
+	state.Count = parseInt(2)
+	for i := 0; i < 5; i++ {
+		state.Q[i] = parseFloat(3 + i)
+		state.N[i] = parseInt(8 + i)
+		state.Np[i] = parseFloat(13 + i)
+		state.Dn[i] = parseFloat(18 + i)
+	}
+
+	return state, err
+}
+
+// validate returns an error when the state can't be the PSQR of a connection.
+func (s PsqrState) validate() error {
+	if s.Connection == "" {
+		return errors.New("missing connection")
+	}
+	if !(s.Perc > 0 && s.Perc < 1) {
+		return fmt.Errorf("invalid perc %v of connection %s: must be between 0 and 1", s.Perc, s.Connection)
+	}
+	if s.Count < 0 {
+		return fmt.Errorf("invalid count %d of connection %s: must not be negative", s.Count, s.Connection)
+	}
+
+	return nil
+}
+
+// ExportState writes the current PSQR of every connection and percentile to w, as CSV with a header row
+// or as a JSON array of PsqrState. Rows are written as they are read, so the export isn't held in memory.
+// Only the current window is exported, previous windows are left out.
+func ExportState(ctx context.Context, w io.Writer, format string) error {
+	var write func(PsqrState) error
+	var finish func() error
+
+	switch format {
+	case FormatCSV:
+		csvWriter := csv.NewWriter(w)
+		if err := csvWriter.Write(stateColumns); err != nil {
+			return fmt.Errorf("failed to write export header: %w", err)
+		}
+
+		write = func(state PsqrState) error {
+			return csvWriter.Write(state.record())
+		}
+		finish = func() error {
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+	case FormatJSON:
+		if _, err := io.WriteString(w, "["); err != nil {
+			return fmt.Errorf("failed to write export: %w", err)
+		}
+
+		first := true
+		write = func(state PsqrState) error {
+			if !first {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			first = false
+
+			data, err := json.Marshal(state)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(data)
+			return err
+		}
+		finish = func() error {
+			_, err := io.WriteString(w, "]\n")
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown export format %q, expected %q or %q", format, FormatCSV, FormatJSON)
+	}
+
+	InitSqlite()
+
+	rows, err := readInstance.QueryContext(ctx, `
+		SELECT c.connectionOrigin, p.perc, p.count,
+			p.q0, p.q1, p.q2, p.q3, p.q4,
+			p.n0, p.n1, p.n2, p.n3, p.n4,
+			p.np0, p.np1, p.np2, p.np3, p.np4,
+			p.dn0, p.dn1, p.dn2, p.dn3, p.dn4
+		FROM connection_psqr cp
+		JOIN connection c ON c.id = cp.connectionId
+		JOIN psqr p ON p.id = cp.psqrId
+		ORDER BY c.connectionOrigin, cp.perc`)
+	if err != nil {
+		return fmt.Errorf("failed to export state: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var state PsqrState
+		err := rows.Scan(
+			&state.Connection, &state.Perc, &state.Count,
+			&state.Q[0], &state.Q[1], &state.Q[2], &state.Q[3], &state.Q[4],
+			&state.N[0], &state.N[1], &state.N[2], &state.N[3], &state.N[4],
+			&state.Np[0], &state.Np[1], &state.Np[2], &state.Np[3], &state.Np[4],
+			&state.Dn[0], &state.Dn[1], &state.Dn[2], &state.Dn[3], &state.Dn[4],
+		)
+		if err != nil {
+			return fmt.Errorf("failed to scan state: %w", err)
+		}
+
+		if err := write(state); err != nil {
+			return fmt.Errorf("failed to write state of connection %s: %w", state.Connection, err)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to export state: %w", err)
+	}
+
+	if err := finish(); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+
+	return nil
+}
+
+// ImportState reads a dump written by ExportState in the given format and makes every PSQR in it the current one
+// of its connection and percentile, creating connections that don't exist yet. Existing current PSQRs are
+// overwritten in place, previous windows are kept. The dump is imported in a single transaction, so nothing
+// is imported when any row is malformed. Unlike other writes only beginning the transaction is retried when
+// the database is busy, the rows read from r can't be read again.
+func ImportState(ctx context.Context, r io.Reader, format string) error {
+	var next func() (PsqrState, error)
+
+	switch format {
+	case FormatCSV:
+		csvReader := csv.NewReader(r)
+		csvReader.FieldsPerRecord = len(stateColumns)
+
+		header, err := csvReader.Read()
+		if err != nil {
+			return fmt.Errorf("failed to read import header: %w", err)
+		}
+		if !slices.Equal(header, stateColumns) {
+			return fmt.Errorf("unexpected import header %v, expected %v", header, stateColumns)
+		}
+
+		next = func() (PsqrState, error) {
+			record, err := csvReader.Read()
+			if err != nil {
+				return PsqrState{}, err
+			}
+			return parseRecord(record)
+		}
+	case FormatJSON:
+		decoder := json.NewDecoder(r)
+		decoder.DisallowUnknownFields()
+
+		if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+			return fmt.Errorf("failed to read import: expected a JSON array")
+		}
+
+		next = func() (PsqrState, error) {
+			if !decoder.More() {
+				if token, err := decoder.Token(); err != nil || token != json.Delim(']') {
+					return PsqrState{}, fmt.Errorf("expected the end of the JSON array")
+				}
+				return PsqrState{}, io.EOF
+			}
+
+			var state PsqrState
+			err := decoder.Decode(&state)
+			return state, err
+		}
+	default:
+		return fmt.Errorf("unknown import format %q, expected %q or %q", format, FormatCSV, FormatJSON)
+	}
+
+	InitSqlite()
+
+	// The transaction takes the write lock when it begins, so waiting for a busy database ends before any row is read
+	var tx *sql.Tx
+	err := retryBusy(ctx, func() (err error) {
+		tx, err = dbInstance.BeginTx(ctx, nil)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for row := 1; ; row++ {
+		state, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read row %d of import: %w", row, err)
+		}
+
+		if err := state.validate(); err != nil {
+			return fmt.Errorf("invalid row %d of import: %w", row, err)
+		}
+
+		if err := upsertCurrentPsqrTransactional(ctx, tx, state); err != nil {
+			return fmt.Errorf("failed to import row %d: %w", row, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// upsertCurrentPsqrTransactional overwrites the current PSQR of a connection and percentile, or inserts it when there is none.
+func upsertCurrentPsqrTransactional(ctx context.Context, tx *sql.Tx, state PsqrState) error {
+	var psqrId int
+	err := tx.QueryRowContext(ctx, currentPsqrIdQuery, state.Connection, state.Perc).Scan(&psqrId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return insertCurrentPsqrTransactional(ctx, tx, state)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get PSQR of connection %s: %w", state.Connection, err)
+	}
+
+	return UpdatePsqrWithTx(ctx, tx, psqrId, state.Perc, state.Count,
+		state.Q[0], state.Q[1], state.Q[2], state.Q[3], state.Q[4],
+		state.N[0], state.N[1], state.N[2], state.N[3], state.N[4],
+		state.Np[0], state.Np[1], state.Np[2], state.Np[3], state.Np[4],
+		state.Dn[0], state.Dn[1], state.Dn[2], state.Dn[3], state.Dn[4],
+	)
+}
@@ -0,0 +1,205 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+// testPsqrState returns the state insertTestPsqr stores.
+func testPsqrState(connection string, perc float64, count int) PsqrState {
+	return PsqrState{
+		Connection: connection,
+		Perc:       perc,
+		Count:      count,
+		Q:          [5]float64{10, 20, 30, 40, 50},
+		N:          [5]int{1, 2, 3, 4, 5},
+		Np:         [5]float64{1, 1 + 2*perc, 1 + 4*perc, 3 + 2*perc, 5},
+		Dn:         [5]float64{0, perc / 2, perc, (1 + perc) / 2, 1},
+	}
+}
+
+func TestExportState(t *testing.T) {
+	ctx := context.Background()
+	openTestDatabase(t)
+
+	// Exported ordered by connection and percentile
+	want := []PsqrState{
+		testPsqrState("a.test", 0.5, 7),
+		testPsqrState("a.test", 0.95, 12),
+		testPsqrState("b.test", 0.95, 5),
+		testPsqrState("c.test", 0.99, 1000),
+	}
+	for _, i := range []int{3, 1, 2, 0} {
+		insertTestPsqr(t, want[i].Connection, want[i].Perc, want[i].Count)
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := ExportState(ctx, &buf, FormatCSV); err != nil {
+			t.Fatalf("ExportState() error = %v", err)
+		}
+
+		records, err := csv.NewReader(&buf).ReadAll()
+		if err != nil {
+			t.Fatalf("failed to parse export: %v", err)
+		}
+		if len(records) == 0 || !slices.Equal(records[0], stateColumns) {
+			t.Fatalf("export header = %v, want %v", records[:min(len(records), 1)], stateColumns)
+		}
+
+		var got []PsqrState
+		for _, record := range records[1:] {
+			state, err := parseRecord(record)
+			if err != nil {
+				t.Fatalf("failed to parse row %v: %v", record, err)
+			}
+			got = append(got, state)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("exported rows = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := ExportState(ctx, &buf, FormatJSON); err != nil {
+			t.Fatalf("ExportState() error = %v", err)
+		}
+
+		var got []PsqrState
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatalf("failed to parse export: %v", err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("exported rows = %+v, want %+v", got, want)
+		}
+	})
+
+	if err := ExportState(ctx, &bytes.Buffer{}, "xml"); err == nil {
+		t.Error("ExportState() in an unknown format succeeded, want an error")
+	}
+}
+
+func TestExportStateEmptyDatabase(t *testing.T) {
+	openTestDatabase(t)
+
+	var buf bytes.Buffer
+	if err := ExportState(context.Background(), &buf, FormatJSON); err != nil {
+		t.Fatalf("ExportState() error = %v", err)
+	}
+
+	var got []PsqrState
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil || len(got) != 0 {
+		t.Errorf("export of an empty database = %q, want an empty array", buf.String())
+	}
+}
+
+// insertState stores state as the current PSQR of its connection.
+func insertState(t *testing.T, state PsqrState) {
+	t.Helper()
+
+	err := InsertConnectionWithPsqr(context.Background(), state.Connection, state.Perc, state.Count,
+		state.Q[0], state.Q[1], state.Q[2], state.Q[3], state.Q[4],
+		state.N[0], state.N[1], state.N[2], state.N[3], state.N[4],
+		state.Np[0], state.Np[1], state.Np[2], state.Np[3], state.Np[4],
+		state.Dn[0], state.Dn[1], state.Dn[2], state.Dn[3], state.Dn[4],
+	)
+	if err != nil {
+		t.Fatalf("InsertConnectionWithPsqr(%q) error = %v", state.Connection, err)
+	}
+}
+
+func TestImportStateRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	// Values without a short decimal representation check that the export loses no precision
+	states := []PsqrState{
+		{Connection: "a.test", Perc: 0.95, Count: 1234, Q: [5]float64{1.0 / 3, 2.0 / 3, 1, 4.0 / 3, 1e9 + 0.1}, N: [5]int{1, 300, 600, 1100, 1234}, Np: [5]float64{1, 617.075, 1233.15, 1175.575, 1234}, Dn: [5]float64{0, 0.475, 0.95, 0.975, 1}},
+		{Connection: "a.test", Perc: 0.99, Count: 5, Q: [5]float64{10, 20, 30, 40, 50}, N: [5]int{1, 2, 3, 4, 5}, Np: [5]float64{1, 2.98, 4.96, 4.98, 5}, Dn: [5]float64{0, 0.495, 0.99, 0.995, 1}},
+		testPsqrState("b.test", 0.95, 42),
+	}
+
+	for _, format := range []string{FormatCSV, FormatJSON} {
+		t.Run(format, func(t *testing.T) {
+			openTestDatabase(t)
+			for _, state := range states {
+				insertState(t, state)
+			}
+
+			want := make([]PsqrRecord, len(states))
+			for i, state := range states {
+				record, err := GetPsqrFromConnection(ctx, state.Connection, state.Perc)
+				if err != nil {
+					t.Fatalf("GetPsqrFromConnection() error = %v", err)
+				}
+				want[i] = record
+			}
+
+			var buf bytes.Buffer
+			if err := ExportState(ctx, &buf, format); err != nil {
+				t.Fatalf("ExportState() error = %v", err)
+			}
+
+			// Import into another database, where the current PSQR of b.test is overwritten
+			openTestDatabase(t)
+			insertTestPsqr(t, "b.test", 0.95, 7)
+			if err := ImportState(ctx, &buf, format); err != nil {
+				t.Fatalf("ImportState() error = %v", err)
+			}
+
+			for i, state := range states {
+				record := want[i]
+				got, err := GetPsqrFromConnection(ctx, state.Connection, state.Perc)
+				if err != nil {
+					t.Fatalf("GetPsqrFromConnection(%q, %v) after import error = %v", state.Connection, state.Perc, err)
+				}
+				if got.Perc != record.Perc || got.Count != record.Count || got.Q != record.Q || got.N != record.N || got.Np != record.Np || got.Dn != record.Dn {
+					t.Errorf("imported PSQR of %s at %v = %+v, want %+v", state.Connection, state.Perc, got, record)
+				}
+			}
+		})
+	}
+}
+
+func TestImportStateRejectsMalformedDump(t *testing.T) {
+	ctx := context.Background()
+	openTestDatabase(t)
+
+	valid := testPsqrState("a.test", 0.95, 5)
+	invalid := testPsqrState("b.test", 1.5, 5)
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(stateColumns)
+	writer.Write(valid.record())
+	writer.Write(invalid.record())
+	writer.Flush()
+
+	if err := ImportState(ctx, &buf, FormatCSV); err == nil {
+		t.Fatal("ImportState() with an invalid row succeeded, want an error")
+	}
+
+	// The valid row before it was rolled back with the rest of the import
+	connections, err := ListConnections(ctx)
+	if err != nil {
+		t.Fatalf("ListConnections() error = %v", err)
+	}
+	if len(connections) != 0 {
+		t.Errorf("connections after a failed import = %v, want none", connections)
+	}
+
+	for _, dump := range []struct{ format, data string }{
+		{FormatCSV, "connection,perc\na.test,0.95\n"},
+		{FormatJSON, `[{"connection":"a.test","perc":0.95,"unknown":1}]`},
+		{FormatJSON, `{"connection":"a.test"}`},
+		{"xml", ""},
+	} {
+		if err := ImportState(ctx, bytes.NewBufferString(dump.data), dump.format); err == nil {
+			t.Errorf("ImportState(%q) as %s succeeded, want an error", dump.data, dump.format)
+		}
+	}
+}
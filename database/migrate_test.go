@@ -0,0 +1,172 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// useMigrationDir makes the test migrate from dir, restoring the embedded migrations when the test ends.
+func useMigrationDir(t *testing.T, dir string) {
+	t.Helper()
+
+	SetMigrationDir(dir)
+	t.Cleanup(func() { SetMigrationDir("") })
+}
+
+// writeMigration writes a migration file to dir.
+func writeMigration(t *testing.T, dir string, name string, contents string) {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+		t.Fatalf("failed to write migration %s: %v", name, err)
+	}
+}
+
+// countRows returns the number of rows in a table.
+func countRows(t *testing.T, table string) int {
+	t.Helper()
+
+	var count int
+	if err := dbInstance.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+		t.Fatalf("failed to count rows of %s: %v", table, err)
+	}
+
+	return count
+}
+
+func TestMigrateAppliesEachMigrationOnce(t *testing.T) {
+	dir := t.TempDir()
+	useMigrationDir(t, dir)
+	useDatabase(t, filepath.Join(t.TempDir(), "classifierData.db"))
+
+	// Seed data is not idempotent, a second run applying it again would insert a second row
+	writeMigration(t, dir, "migration1.sql", "CREATE TABLE seed (value TEXT);")
+	writeMigration(t, dir, "migration2.sql", "INSERT INTO seed (value) VALUES ('once');")
+
+	if err := migrate(); err != nil {
+		t.Fatalf("first migrate() error = %v", err)
+	}
+	if err := migrate(); err != nil {
+		t.Fatalf("second migrate() error = %v", err)
+	}
+
+	if got := countRows(t, "seed"); got != 1 {
+		t.Errorf("seed rows after migrating twice = %d, want 1", got)
+	}
+	if got := countRows(t, "schema_migrations"); got != 2 {
+		t.Errorf("recorded migrations = %d, want 2", got)
+	}
+
+	// A new migration is applied on the next run, the recorded ones still aren't
+	writeMigration(t, dir, "migration3.sql", "INSERT INTO seed (value) VALUES ('new');")
+	if err := migrate(); err != nil {
+		t.Fatalf("third migrate() error = %v", err)
+	}
+	if got := countRows(t, "seed"); got != 2 {
+		t.Errorf("seed rows after adding a migration = %d, want 2", got)
+	}
+}
+
+func TestMigrateRejectsChangedMigration(t *testing.T) {
+	dir := t.TempDir()
+	useMigrationDir(t, dir)
+	useDatabase(t, filepath.Join(t.TempDir(), "classifierData.db"))
+
+	writeMigration(t, dir, "migration1.sql", "CREATE TABLE seed (value TEXT);")
+	if err := migrate(); err != nil {
+		t.Fatalf("migrate() error = %v", err)
+	}
+
+	writeMigration(t, dir, "migration1.sql", "CREATE TABLE seed (value TEXT, other TEXT);")
+	err := migrate()
+	if err == nil {
+		t.Fatal("migrate() after changing an applied migration succeeded, want an error")
+	}
+	if !strings.Contains(err.Error(), "migration1.sql has changed") {
+		t.Errorf("migrate() error = %v, want it to name the changed migration", err)
+	}
+}
+
+func TestMigrateRejectsDuplicateVersions(t *testing.T) {
+	dir := t.TempDir()
+	useMigrationDir(t, dir)
+	useDatabase(t, filepath.Join(t.TempDir(), "classifierData.db"))
+
+	writeMigration(t, dir, "1_create.sql", "CREATE TABLE seed (value TEXT);")
+	writeMigration(t, dir, "0001_other.sql", "CREATE TABLE other (value TEXT);")
+
+	if err := migrate(); err == nil {
+		t.Fatal("migrate() with two migrations of version 1 succeeded, want an error")
+	}
+}
+
+func TestMigrateFromAnotherWorkingDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "classifierData.db")
+	useDatabase(t, path)
+
+	// Nothing named migrations is reachable from here, the embedded migrations are used
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd() error = %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Chdir() error = %v", err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Errorf("Chdir() error = %v", err)
+		}
+	})
+
+	if err := migrate(); err != nil {
+		t.Fatalf("migrate() error = %v", err)
+	}
+
+	for _, table := range []string{"connection", "psqr", "connection_psqr", "score_history"} {
+		if got := countRows(t, table); got != 0 {
+			t.Errorf("rows of %s = %d, want an empty table", table, got)
+		}
+	}
+	if got := countRows(t, "schema_migrations"); got != 4 {
+		t.Errorf("recorded migrations = %d, want the 4 embedded ones", got)
+	}
+}
+
+func TestMigrateAppliesInNumericOrder(t *testing.T) {
+	dir := t.TempDir()
+	useMigrationDir(t, dir)
+	useDatabase(t, filepath.Join(t.TempDir(), "classifierData.db"))
+
+	// Lexically 10_ sorts before 2_, it would insert into a table that doesn't exist yet
+	writeMigration(t, dir, "1_create.sql", "CREATE TABLE steps (step INTEGER);")
+	writeMigration(t, dir, "2_first.sql", "INSERT INTO steps (step) VALUES (2);")
+	writeMigration(t, dir, "10_second.sql", "INSERT INTO steps (step) VALUES (10);")
+
+	if err := migrate(); err != nil {
+		t.Fatalf("migrate() error = %v", err)
+	}
+
+	rows, err := dbInstance.Query("SELECT step FROM steps ORDER BY rowid")
+	if err != nil {
+		t.Fatalf("failed to query steps: %v", err)
+	}
+	defer rows.Close()
+
+	var steps []int
+	for rows.Next() {
+		var step int
+		if err := rows.Scan(&step); err != nil {
+			t.Fatalf("failed to scan step: %v", err)
+		}
+		steps = append(steps, step)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("failed to read steps: %v", err)
+	}
+	if want := []int{2, 10}; !slices.Equal(steps, want) {
+		t.Errorf("applied steps = %v, want %v", steps, want)
+	}
+}
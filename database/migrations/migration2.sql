@@ -0,0 +1,16 @@
+-- Store the current psqr of a connection per percentile instead of one column per percentile --
+
+CREATE TABLE IF NOT EXISTS connection_psqr (
+    connectionId INTEGER NOT NULL,  -- The connection id
+    perc REAL NOT NULL,             -- The percentile the psqr estimates
+    psqrId INTEGER NOT NULL,        -- The current psqr id for this percentile
+    PRIMARY KEY (connectionId, perc),
+    FOREIGN KEY (connectionId) REFERENCES connection(id),
+    FOREIGN KEY (psqrId) REFERENCES psqr(id)
+);
+
+-- Carry over the existing p95 estimators
+INSERT OR IGNORE INTO connection_psqr (connectionId, perc, psqrId)
+SELECT id, 0.95, currentPsqr95Id FROM connection;
+
+ALTER TABLE connection DROP COLUMN currentPsqr95Id;
@@ -0,0 +1,3 @@
+-- Index the psqr history chain so pruning and deleting previous psqrs doesn't scan the table --
+
+CREATE INDEX IF NOT EXISTS idx_psqr_previousPsqrId ON psqr(previousPsqrId);
@@ -0,0 +1,10 @@
+-- Keep a sampled history of the smoothed score of every connection to chart trends --
+
+CREATE TABLE IF NOT EXISTS score_history (
+    connectionOrigin TEXT NOT NULL, -- The origin of the connection
+    timestamp INTEGER NOT NULL,     -- When the score was recorded, in unix milliseconds
+    score REAL NOT NULL             -- The smoothed score at that time
+);
+
+CREATE INDEX IF NOT EXISTS idx_score_history_connection_timestamp ON score_history(connectionOrigin, timestamp);
+CREATE INDEX IF NOT EXISTS idx_score_history_timestamp ON score_history(timestamp);
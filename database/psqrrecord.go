@@ -0,0 +1,49 @@
+package database
+
+import "database/sql"
+
+// selectPsqrQuery selects a PSQR by its id, with its columns in the order scanned by scanPsqr.
+const selectPsqrQuery = "SELECT id, previousPsqrId, perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4 FROM psqr WHERE id = ?"
+
+// PsqrRecord is a PSQR as stored in the psqr table.
+type PsqrRecord struct {
+	ID         int
+	PreviousID *int // PSQR of the previous window, nil when there is none
+	Perc       float64
+	Count      int
+	Q          [5]float64
+	N          [5]int
+	Np         [5]float64
+	Dn         [5]float64
+}
+
+// scanPsqr scans a row selected by selectPsqrQuery. A missing row results in ErrPsqrNotFound.
+func scanPsqr(row *sql.Row) (PsqrRecord, error) {
+	var record PsqrRecord
+	var previousPsqrId sql.NullInt64
+
+	err := row.Scan(
+		&record.ID,
+		&previousPsqrId,
+		&record.Perc,
+		&record.Count,
+		&record.Q[0], &record.Q[1], &record.Q[2], &record.Q[3], &record.Q[4],
+		&record.N[0], &record.N[1], &record.N[2], &record.N[3], &record.N[4],
+		&record.Np[0], &record.Np[1], &record.Np[2], &record.Np[3], &record.Np[4],
+		&record.Dn[0], &record.Dn[1], &record.Dn[2], &record.Dn[3], &record.Dn[4],
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return PsqrRecord{}, ErrPsqrNotFound
+		}
+		return PsqrRecord{}, err
+	}
+
+	// Let database/sql convert the column so the result doesn't depend on the type the driver scans it as
+	if previousPsqrId.Valid {
+		previousId := int(previousPsqrId.Int64)
+		record.PreviousID = &previousId
+	}
+
+	return record, nil
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const (
+	// busyPoll is how long SQLite itself waits for a lock on the writer connection. SQLite keeps waiting when
+	// the context of the statement is done, so the rest of the busy timeout is waited for by retryBusy.
+	busyPoll = 50 * time.Millisecond
+
+	// busyBackoff is the delay before the first retry, doubling with every following attempt up to maxBusyBackoff.
+	busyBackoff = 10 * time.Millisecond
+
+	// maxBusyBackoff is the longest delay between two attempts.
+	maxBusyBackoff = 200 * time.Millisecond
+)
+
+// isBusy reports whether err was caused by the database being busy or locked by another connection.
+func isBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	// Extended result codes keep the primary result code in the lower byte
+	code := sqliteErr.Code() & 0xff
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// retryBusy runs fn until it succeeds, fails for another reason than the database being busy or the busy
+// timeout of the configuration has passed, backing off exponentially in between. Giving up returns an error
+// matching ErrBusy, a context that is done stops the waiting early. fn must be safe to run
+// again after failing, which holds for functions doing all their work within a single transaction.
+func retryBusy(ctx context.Context, fn func() error) error {
+	backoff := busyBackoff
+	deadline := time.Now().Add(sqliteConfig.BusyTimeout)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || !isBusy(err) {
+			return err
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%w after %d attempts: %w", ErrBusy, attempt, err)
+		}
+
+		logger.WarnContext(ctx, "database busy, retrying",
+			slog.Int("attempt", attempt),
+			slog.Duration("backoff", backoff),
+			slog.Any("error", err),
+		)
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBusyBackoff)
+	}
+}
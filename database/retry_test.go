@@ -0,0 +1,90 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// holdWriteLock takes the write lock of the database at path through a separate connection, until the
+// returned function is called.
+func holdWriteLock(t *testing.T, path string) func() {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatalf("failed to open the database: %v", err)
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get a connection: %v", err)
+	}
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatalf("failed to take the write lock: %v", err)
+	}
+
+	return func() {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		conn.Close()
+		db.Close()
+	}
+}
+
+// openBusyTestDatabase opens a migrated database in a temporary directory with the given busy timeout.
+func openBusyTestDatabase(t *testing.T, busyTimeout time.Duration) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "classifierData.db")
+	useDatabase(t, path)
+	if err := Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	cfg := DefaultSqliteConfig()
+	cfg.Path = path
+	cfg.BusyTimeout = busyTimeout
+	if err := SetSqliteConfig(cfg); err != nil {
+		t.Fatalf("SetSqliteConfig() error = %v", err)
+	}
+	Migrate()
+
+	return path
+}
+
+func TestRetryBusySucceedsOnceTheLockIsReleased(t *testing.T) {
+	path := openBusyTestDatabase(t, 5*time.Second)
+	insertTestPsqr(t, "busy", 0.95, 5)
+
+	const hold = 300 * time.Millisecond
+	release := holdWriteLock(t, path)
+	time.AfterFunc(hold, release)
+
+	start := time.Now()
+	if _, err := SwapPsqr(context.Background(), "busy", 0.95); err != nil {
+		t.Fatalf("SwapPsqr() while the database was locked error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < hold {
+		t.Errorf("SwapPsqr() returned after %s, want it to wait for the lock held for %s", elapsed, hold)
+	}
+
+	record, err := GetPsqrFromConnection(context.Background(), "busy", 0.95)
+	if err != nil || record.PreviousID == nil {
+		t.Errorf("GetPsqrFromConnection() after the retried swap = %+v, %v, want a swapped window", record, err)
+	}
+}
+
+func TestRetryBusyGivesUpWithErrBusy(t *testing.T) {
+	path := openBusyTestDatabase(t, 200*time.Millisecond)
+
+	release := holdWriteLock(t, path)
+	defer release()
+
+	err := InsertConnectionWithPsqr(context.Background(), "busy", 0.95, 5,
+		10, 20, 30, 40, 50, 1, 2, 3, 4, 5, 1, 2, 3, 4, 5, 0, 0.475, 0.95, 0.975, 1)
+	if !errors.Is(err, ErrBusy) {
+		t.Errorf("InsertConnectionWithPsqr() on a locked database error = %v, want one matching ErrBusy", err)
+	}
+}
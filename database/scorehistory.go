@@ -0,0 +1,84 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ScorePoint is the smoothed score of a connection at a point in time.
+type ScorePoint struct {
+	Time  time.Time
+	Score float64
+}
+
+// InsertScore records the score of a connection at the given time.
+func InsertScore(ctx context.Context, connection string, at time.Time, score float64) error {
+	return retryBusy(ctx, func() error {
+		InitSqlite()
+
+		_, err := dbInstance.ExecContext(ctx,
+			"INSERT INTO score_history (connectionOrigin, timestamp, score) VALUES (?, ?, ?)",
+			connection, at.UnixMilli(), score,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert score of connection %s: %w", connection, err)
+		}
+
+		return nil
+	})
+}
+
+// GetScoreHistory returns the recorded scores of a connection at or after since, oldest first.
+func GetScoreHistory(ctx context.Context, connection string, since time.Time) ([]ScorePoint, error) {
+	InitSqlite()
+
+	rows, err := readInstance.QueryContext(ctx,
+		"SELECT timestamp, score FROM score_history WHERE connectionOrigin = ? AND timestamp >= ? ORDER BY timestamp",
+		connection, since.UnixMilli(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get score history of connection %s: %w", connection, err)
+	}
+	defer rows.Close()
+
+	points := []ScorePoint{}
+	for rows.Next() {
+		var timestamp int64
+		var score float64
+		if err := rows.Scan(&timestamp, &score); err != nil {
+			return nil, fmt.Errorf("failed to scan score: %w", err)
+		}
+		points = append(points, ScorePoint{Time: time.UnixMilli(timestamp), Score: score})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get score history of connection %s: %w", connection, err)
+	}
+
+	return points, nil
+}
+
+// PruneScoreHistory deletes the scores of every connection recorded before the given time
+// and returns the number of deleted scores. Call it periodically to bound the size of the history.
+func PruneScoreHistory(ctx context.Context, before time.Time) (int64, error) {
+	var deleted int64
+
+	err := retryBusy(ctx, func() error {
+		InitSqlite()
+
+		result, err := dbInstance.ExecContext(ctx, "DELETE FROM score_history WHERE timestamp < ?", before.UnixMilli())
+		if err != nil {
+			return fmt.Errorf("failed to prune score history: %w", err)
+		}
+
+		deleted, err = result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to prune score history: %w", err)
+		}
+
+		return nil
+	})
+
+	return deleted, err
+}
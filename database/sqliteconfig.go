@@ -0,0 +1,90 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SqliteConfig holds the database file and the pragmas every connection to the database is opened with.
+type SqliteConfig struct {
+	Path        string        // Path of the database file, created when it doesn't exist
+	JournalMode string        // journal_mode pragma: WAL, DELETE, TRUNCATE, PERSIST or MEMORY
+	Synchronous string        // synchronous pragma: OFF, NORMAL, FULL or EXTRA, empty keeps the SQLite default
+	BusyTimeout time.Duration // How long a connection waits for a lock before failing
+}
+
+// sqliteConfig is the configuration the database is opened with.
+var sqliteConfig = DefaultSqliteConfig()
+
+// DefaultSqliteConfig returns the configuration the database is opened with unless SetSqliteConfig changed it:
+// classifierData.db in the working directory, a WAL journal so readers proceed concurrently with the writer,
+// the default synchronous setting and a busy timeout of five seconds.
+func DefaultSqliteConfig() SqliteConfig {
+	return SqliteConfig{
+		Path:        "./classifierData.db",
+		JournalMode: "WAL",
+		BusyTimeout: 5 * time.Second,
+	}
+}
+
+// Validate returns an error when the path is empty, a pragma has an unknown value or the combination makes no sense.
+// A synchronous setting of FULL or EXTRA is rejected with a MEMORY journal, the journal is lost on a crash
+// anyway so the durability asked for can't be delivered. Journal mode OFF is not supported at all, rolling
+// back a transaction is undefined without a journal and failed writes are rolled back.
+func (c SqliteConfig) Validate() error {
+	journalMode := strings.ToUpper(c.JournalMode)
+	synchronous := strings.ToUpper(c.Synchronous)
+
+	if c.Path == "" {
+		return errors.New("invalid database path: must not be empty")
+	}
+
+	if !slices.Contains([]string{"WAL", "DELETE", "TRUNCATE", "PERSIST", "MEMORY"}, journalMode) {
+		return fmt.Errorf("invalid journal mode %q: must be WAL, DELETE, TRUNCATE, PERSIST or MEMORY", c.JournalMode)
+	}
+
+	if synchronous != "" && !slices.Contains([]string{"OFF", "NORMAL", "FULL", "EXTRA"}, synchronous) {
+		return fmt.Errorf("invalid synchronous setting %q: must be OFF, NORMAL, FULL or EXTRA", c.Synchronous)
+	}
+
+	if journalMode == "MEMORY" && (synchronous == "FULL" || synchronous == "EXTRA") {
+		return fmt.Errorf("invalid synchronous setting %s with journal mode %s: the journal doesn't survive a crash", synchronous, journalMode)
+	}
+
+	if c.BusyTimeout < 0 {
+		return fmt.Errorf("invalid busy timeout %s: must not be negative", c.BusyTimeout)
+	}
+
+	return nil
+}
+
+// dsn returns the data source name opening the database with the pragmas of the configuration and the given
+// busy_timeout pragma.
+func (c SqliteConfig) dsn(busyTimeout time.Duration) string {
+	dsn := fmt.Sprintf("file:%s?_pragma=journal_mode(%s)&_pragma=busy_timeout(%d)", c.Path, strings.ToUpper(c.JournalMode), busyTimeout.Milliseconds())
+	if c.Synchronous != "" {
+		dsn += fmt.Sprintf("&_pragma=synchronous(%s)", strings.ToUpper(c.Synchronous))
+	}
+
+	return dsn
+}
+
+// SetSqliteConfig sets the database file and the pragmas it is opened with, it must be called before the
+// database is used or after Close, for instance to open a different database. An error is returned when the
+// configuration is invalid, see SqliteConfig.Validate, or the database is already open.
+func SetSqliteConfig(cfg SqliteConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if dbInstance != nil {
+		return errors.New("failed to configure database: the database is already open")
+	}
+
+	sqliteConfig = cfg
+
+	return nil
+}
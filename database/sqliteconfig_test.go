@@ -0,0 +1,92 @@
+package database
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSqliteConfig opens the database with cfg for the rest of the test.
+func useSqliteConfig(t *testing.T, cfg SqliteConfig) {
+	t.Helper()
+
+	useDatabase(t, cfg.Path)
+	if err := SetSqliteConfig(cfg); err != nil {
+		t.Fatalf("SetSqliteConfig() error = %v", err)
+	}
+	InitSqlite()
+}
+
+// pragma returns the value of a pragma on a connection of db.
+func pragma(t *testing.T, db *sql.DB, name string) string {
+	t.Helper()
+
+	var value string
+	if err := db.QueryRow("PRAGMA " + name).Scan(&value); err != nil {
+		t.Fatalf("PRAGMA %s error = %v", name, err)
+	}
+
+	return value
+}
+
+func TestSqliteConfigPragmasTakeEffect(t *testing.T) {
+	for _, tt := range []struct {
+		journalMode, synchronous string
+		wantJournal, wantSync    string
+	}{
+		{journalMode: "WAL", wantJournal: "wal", wantSync: "2"},
+		{journalMode: "memory", synchronous: "off", wantJournal: "memory", wantSync: "0"},
+		{journalMode: "DELETE", synchronous: "EXTRA", wantJournal: "delete", wantSync: "3"},
+	} {
+		cfg := DefaultSqliteConfig()
+		cfg.Path = filepath.Join(t.TempDir(), "classifierData.db")
+		cfg.JournalMode = tt.journalMode
+		cfg.Synchronous = tt.synchronous
+		useSqliteConfig(t, cfg)
+
+		// Both the writer and the readers are opened with the pragmas
+		for name, db := range map[string]*sql.DB{"writer": dbInstance, "reader": readInstance} {
+			if got := pragma(t, db, "journal_mode"); got != tt.wantJournal {
+				t.Errorf("%s/%s: %s journal_mode = %s, want %s", tt.journalMode, tt.synchronous, name, got, tt.wantJournal)
+			}
+			if got := pragma(t, db, "synchronous"); got != tt.wantSync {
+				t.Errorf("%s/%s: %s synchronous = %s, want %s", tt.journalMode, tt.synchronous, name, got, tt.wantSync)
+			}
+		}
+
+		if err := Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+	}
+}
+
+func TestSqliteConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		cfg   func(*SqliteConfig)
+		valid bool
+	}{
+		{name: "default", cfg: func(*SqliteConfig) {}, valid: true},
+		{name: "lowercase", cfg: func(c *SqliteConfig) { c.JournalMode, c.Synchronous = "truncate", "normal" }, valid: true},
+		{name: "empty path", cfg: func(c *SqliteConfig) { c.Path = "" }},
+		{name: "journal mode off", cfg: func(c *SqliteConfig) { c.JournalMode = "OFF" }},
+		{name: "unknown synchronous", cfg: func(c *SqliteConfig) { c.Synchronous = "SOMETIMES" }},
+		{name: "full with memory journal", cfg: func(c *SqliteConfig) { c.JournalMode, c.Synchronous = "MEMORY", "FULL" }},
+		{name: "negative busy timeout", cfg: func(c *SqliteConfig) { c.BusyTimeout = -time.Second }},
+	} {
+		cfg := DefaultSqliteConfig()
+		tt.cfg(&cfg)
+		if err := cfg.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: Validate() error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+
+	// The configuration can't change while the database is open
+	openTestDatabase(t)
+	err := SetSqliteConfig(DefaultSqliteConfig())
+	if err == nil || !strings.Contains(err.Error(), "already open") {
+		t.Errorf("SetSqliteConfig() on an open database error = %v, want it rejected", err)
+	}
+}
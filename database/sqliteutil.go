@@ -1,91 +1,310 @@
 package database
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"log/slog"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"unicode"
 
 	_ "modernc.org/sqlite"
 )
 
+const (
+	// currentPsqrIdQuery selects the current PSQR id of a connection for a given percentile.
+	currentPsqrIdQuery = "SELECT cp.psqrId FROM connection_psqr cp JOIN connection c ON c.id = cp.connectionId WHERE c.connectionOrigin = ? AND cp.perc = ?"
+
+	// setCurrentPsqrIdQuery points a connection's percentile at a different PSQR id.
+	setCurrentPsqrIdQuery = "UPDATE connection_psqr SET psqrId = ? WHERE perc = ? AND connectionId = (SELECT id FROM connection WHERE connectionOrigin = ?)"
+)
+
 var (
-	dbPath        = "./classifierData.db"
-	migrationPath = "./sqlitemigrations"
-	dbInstance    *sql.DB
-	once          sync.Once
+	migrationDir = ""    // External directory to read migrations from, empty reads the embedded migrations
+	dbInstance   *sql.DB // Single connection all writes go through
+	readInstance *sql.DB // Pool of read-only connections reading concurrently with the writer
+	once         sync.Once
+	logger       = slog.New(slog.NewTextHandler(io.Discard, nil)) // Discards the logs until SetLogger is called
 )
 
-// InitSqlite initializes the SQLite database with necessary configurations.
+// embeddedMigrations are the migrations shipped in the binary, so Migrate works from any working directory.
+//
+//go:embed migrations/*.sql
+var embeddedMigrations embed.FS
+
+// defaultMaxReadConns is the default number of concurrent read connections.
+const defaultMaxReadConns = 4
+
+// InitSqlite initializes the SQLite database with the configuration set with SetSqliteConfig.
 // It ensures that only one instance of *sql.DB is created using sync.Once.
 func InitSqlite() {
 	var err error
 	once.Do(func() {
-		// Data Source Name (DSN) with configurations:
-		// - Enable Foreign Keys
-		// - Set Journal Mode to WAL for better concurrency
-		// - Set Busy Timeout to 5000 milliseconds
-		dsn := fmt.Sprintf("file:%s?_foreign_keys=on&_journal_mode=WAL&_busy_timeout=5000", dbPath)
-		dbInstance, err = sql.Open("sqlite", dsn)
+		// Data Source Name (DSN) with the pragmas set with SetSqliteConfig, a WAL journal by default.
+		// Foreign keys are not enforced, the original connection table declares a foreign key from
+		// connectionOrigin to psqr(id) that would reject every connection.
+		// The writer only waits busyPoll for a lock in SQLite, the rest of the busy timeout is waited for by
+		// retryBusy so a cancelled context stops the waiting. Transactions take the write lock when they
+		// begin, so a busy database fails the transaction before any of its work is done.
+		dbInstance, err = sql.Open("sqlite", sqliteConfig.dsn(min(busyPoll, sqliteConfig.BusyTimeout))+"&_txlock=immediate")
 		if err != nil {
 			log.Fatalf("Failed to open database: %v", err)
 		}
 
-		// Limit the number of open connections to 1 to prevent lock contention
+		// SQLite allows a single writer, so limit the writer to one connection to prevent lock contention
 		dbInstance.SetMaxOpenConns(1)
 
 		// Verify the connection
 		if err = dbInstance.Ping(); err != nil {
 			log.Fatalf("Failed to ping database: %v", err)
 		}
+
+		readInstance, err = sql.Open("sqlite", sqliteConfig.dsn(sqliteConfig.BusyTimeout)+"&_pragma=query_only(1)")
+		if err != nil {
+			log.Fatalf("Failed to open database for reading: %v", err)
+		}
+
+		readInstance.SetMaxOpenConns(defaultMaxReadConns)
+
+		if err = readInstance.Ping(); err != nil {
+			log.Fatalf("Failed to ping database for reading: %v", err)
+		}
 	})
 }
 
-// Migrate applies all SQL migration files to the database.
-// It ensures that migrations are applied using the persistent dbInstance.
+// Close closes the database connections and resets the package, so the next call to any database function
+// opens the database again. Close resets the sync.Once guarding InitSqlite, so it must not be called
+// concurrently with other database functions. Closing a database that isn't open does nothing.
+func Close() error {
+	if dbInstance == nil {
+		return nil
+	}
+
+	err := errors.Join(readInstance.Close(), dbInstance.Close())
+
+	dbInstance, readInstance = nil, nil
+	once = sync.Once{}
+
+	if err != nil {
+		return fmt.Errorf("failed to close database: %w", err)
+	}
+
+	return nil
+}
+
+// SetLogger sets the logger the database layer logs to, it should be called before the database is used.
+// A nil logger discards the logs again.
+// Failures that leave the database unusable, while opening or migrating it, still exit through the log package.
+func SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	logger = l
+}
+
+// SetMaxOpenConns sets the maximum number of connections used to read concurrently.
+// Writes always go through a single connection since SQLite only allows one writer at a time.
+func SetMaxOpenConns(n int) {
+	InitSqlite()
+
+	readInstance.SetMaxOpenConns(n)
+}
+
+// Migrate applies all pending SQL migration files to the database.
+// Applied migrations are recorded in the schema_migrations table together with
+// a checksum of their contents, so each file is executed only once. A previously
+// applied file whose contents have changed is treated as a fatal error. Files are applied in the order
+// of the version number in their name, two files with the same version are a fatal error as well.
+// The migrations are embedded in the binary unless SetMigrationDir selected an external directory.
 func Migrate() {
+	if err := migrate(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// migrate applies the pending migrations like Migrate, returning the errors Migrate treats as fatal.
+func migrate() error {
 	InitSqlite()
 
+	// Make sure the migration bookkeeping table exists
+	err := retryBusy(context.Background(), func() error {
+		_, err := dbInstance.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+			filename TEXT PRIMARY KEY,
+			checksum TEXT NOT NULL,
+			appliedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
 	// Read migration files
-	files, err := os.ReadDir(migrationPath)
+	migrations, err := migrationFS()
+	if err != nil {
+		return fmt.Errorf("failed to open migration directory: %w", err)
+	}
+
+	files, err := fs.ReadDir(migrations, ".")
 	if err != nil {
-		log.Fatalf("Failed to read migration directory: %v", err)
+		return fmt.Errorf("failed to read migration directory: %w", err)
+	}
+
+	files, err = sortMigrations(files)
+	if err != nil {
+		return fmt.Errorf("failed to order migrations: %w", err)
 	}
 
 	// Apply each migration
 	for _, file := range files {
-		if file.IsDir() {
+
+		migration, err := fs.ReadFile(migrations, file.Name())
+		if err != nil {
+			return fmt.Errorf("failed to read migration file %s: %w", file.Name(), err)
+		}
+
+		sum := sha256.Sum256(migration)
+		checksum := hex.EncodeToString(sum[:])
+
+		// Skip migrations that have already been applied
+		var appliedChecksum string
+		err = dbInstance.QueryRow("SELECT checksum FROM schema_migrations WHERE filename = ?", file.Name()).Scan(&appliedChecksum)
+		if err == nil {
+			if appliedChecksum != checksum {
+				return fmt.Errorf("migration %s has changed since it was applied (checksum %s, expected %s)", file.Name(), checksum, appliedChecksum)
+			}
 			continue
+		} else if err != sql.ErrNoRows {
+			return fmt.Errorf("failed to query schema_migrations for %s: %w", file.Name(), err)
 		}
 
-		fmt.Println("Migrating:", file.Name())
-		migration, err := os.ReadFile(fmt.Sprintf("%s/%s", migrationPath, file.Name()))
-		if err != nil {
-			log.Fatalf("Failed to read migration file %s: %v", file.Name(), err)
+		logger.Info("applying migration", slog.String("file", file.Name()))
+
+		if err := retryBusy(context.Background(), func() error { return applyMigration(file.Name(), migration, checksum) }); err != nil {
+			return err
 		}
+	}
 
-		// Execute migration within a transaction
-		tx, err := dbInstance.Begin()
-		if err != nil {
-			log.Fatalf("Failed to begin transaction for migration %s: %v", file.Name(), err)
+	return nil
+}
+
+// applyMigration executes a migration and records it in schema_migrations within a single transaction.
+func applyMigration(name string, migration []byte, checksum string) error {
+	tx, err := dbInstance.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for migration %s: %w", name, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(string(migration))
+	if err != nil {
+		return fmt.Errorf("failed to execute migration %s: %w", name, err)
+	}
+
+	_, err = tx.Exec("INSERT INTO schema_migrations (filename, checksum) VALUES (?, ?)", name, checksum)
+	if err != nil {
+		return fmt.Errorf("failed to record migration %s: %w", name, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// migrationVersion returns the version of a migration file, the first number in its name,
+// so "migration10.sql", "10_add_index.sql" and "0010_add_index.sql" all have version 10.
+func migrationVersion(name string) (int, error) {
+	start := strings.IndexFunc(name, unicode.IsDigit)
+	if start < 0 {
+		return 0, fmt.Errorf("migration %s has no version number in its name", name)
+	}
+
+	end := start
+	for end < len(name) && unicode.IsDigit(rune(name[end])) {
+		end++
+	}
+
+	version, err := strconv.Atoi(name[start:end])
+	if err != nil {
+		return 0, fmt.Errorf("invalid version number in migration %s: %w", name, err)
+	}
+
+	return version, nil
+}
+
+// sortMigrations returns the migration files ordered by their numeric version rather than by name,
+// skipping directories. It returns an error when two files share a version, their order would be ambiguous.
+func sortMigrations(entries []fs.DirEntry) ([]fs.DirEntry, error) {
+	type versioned struct {
+		entry   fs.DirEntry
+		version int
+	}
+
+	migrations := make([]versioned, 0, len(entries))
+	seen := make(map[int]string, len(entries))
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
 		}
 
-		_, err = tx.Exec(string(migration))
+		version, err := migrationVersion(entry.Name())
 		if err != nil {
-			tx.Rollback()
-			log.Fatalf("Failed to execute migration %s: %v", file.Name(), err)
+			return nil, err
 		}
 
-		if err = tx.Commit(); err != nil {
-			log.Fatalf("Failed to commit migration %s: %v", file.Name(), err)
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, entry.Name(), version)
 		}
+		seen[version] = entry.Name()
+
+		migrations = append(migrations, versioned{entry: entry, version: version})
 	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	sorted := make([]fs.DirEntry, len(migrations))
+	for i, migration := range migrations {
+		sorted[i] = migration.entry
+	}
+
+	return sorted, nil
+}
+
+// SetMigrationDir makes Migrate read the migrations from an external directory instead of the embedded ones,
+// for instance to try a migration without rebuilding. An empty dir restores the embedded migrations.
+func SetMigrationDir(dir string) {
+	migrationDir = dir
+}
+
+// migrationFS returns the file system holding the migrations to apply.
+func migrationFS() (fs.FS, error) {
+	if migrationDir != "" {
+		return os.DirFS(migrationDir), nil
+	}
+
+	return fs.Sub(embeddedMigrations, "migrations")
 }
 
 // InsertConnectionWithPsqr inserts or updates a connection with associated PSQR data.
 // It uses the persistent dbInstance and handles concurrency appropriately.
 func InsertConnectionWithPsqr(
+	ctx context.Context,
 	connection string,
 	perc float64,
 	count int,
@@ -93,59 +312,113 @@ func InsertConnectionWithPsqr(
 	n0, n1, n2, n3, n4 int,
 	np0, np1, np2, np3, np4 float64,
 	dn0, dn1, dn2, dn3, dn4 float64,
-) {
+) error {
+	return retryBusy(ctx, func() error {
+		return insertConnectionWithPsqr(ctx, connection, perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4)
+	})
+}
+
+func insertConnectionWithPsqr(
+	ctx context.Context,
+	connection string,
+	perc float64,
+	count int,
+	q0, q1, q2, q3, q4 float64,
+	n0, n1, n2, n3, n4 int,
+	np0, np1, np2, np3, np4 float64,
+	dn0, dn1, dn2, dn3, dn4 float64,
+) error {
 	InitSqlite()
 
-	// Use a transaction to ensure atomicity
-	tx, err := dbInstance.Begin()
+	// Update the current PSQR of the connection in place, a single statement is atomic on its own
+	res, err := dbInstance.ExecContext(ctx,
+		"UPDATE psqr SET perc = ?, count = ?, q0 = ?, q1 = ?, q2 = ?, q3 = ?, q4 = ?, n0 = ?, n1 = ?, n2 = ?, n3 = ?, n4 = ?, np0 = ?, np1 = ?, np2 = ?, np3 = ?, np4 = ?, dn0 = ?, dn1 = ?, dn2 = ?, dn3 = ?, dn4 = ? WHERE id = ("+currentPsqrIdQuery+")",
+		perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4, connection, perc,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update psqr: %w", err)
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if updated > 0 {
+		return nil
+	}
+
+	// The connection has no PSQR for this percentile yet, use a transaction to ensure atomicity
+	tx, err := dbInstance.BeginTx(ctx, nil)
 	if err != nil {
-		log.Fatalf("Failed to begin transaction: %v", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	// Check if connection already exists
-	var psqrId int
-	query := fmt.Sprintf("SELECT currentPsqr%dId FROM connection WHERE connectionOrigin = ?", int(perc*100))
-
-	err = tx.QueryRow(query, connection).Scan(&psqrId)
-	if err == nil {
-		// Connection exists, update the PSQR
-		UpdatePsqrWithTx(tx, psqrId, perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4)
-		if err = tx.Commit(); err != nil {
-			log.Fatalf("Failed to commit transaction: %v", err)
-		}
-		return
-	} else if err != sql.ErrNoRows {
-		log.Fatalf("Failed to query connection: %v", err)
+	state := PsqrState{
+		Connection: connection,
+		Perc:       perc,
+		Count:      count,
+		Q:          [5]float64{q0, q1, q2, q3, q4},
+		N:          [5]int{n0, n1, n2, n3, n4},
+		Np:         [5]float64{np0, np1, np2, np3, np4},
+		Dn:         [5]float64{dn0, dn1, dn2, dn3, dn4},
+	}
+	if err := insertCurrentPsqrTransactional(ctx, tx, state); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
+	return nil
+}
+
+// insertCurrentPsqrTransactional inserts a PSQR and makes it the current one of its connection and percentile,
+// inserting the connection if it doesn't exist yet.
+func insertCurrentPsqrTransactional(ctx context.Context, tx *sql.Tx, state PsqrState) error {
+	connection, perc := state.Connection, state.Perc
+	q, n, np, dn := state.Q, state.N, state.Np, state.Dn
+
 	// Insert into psqr and get the inserted ID
-	res, err := tx.Exec(
+	res, err := tx.ExecContext(ctx,
 		"INSERT INTO psqr (perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
-		perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4,
+		perc, state.Count, q[0], q[1], q[2], q[3], q[4], n[0], n[1], n[2], n[3], n[4], np[0], np[1], np[2], np[3], np[4], dn[0], dn[1], dn[2], dn[3], dn[4],
 	)
 	if err != nil {
-		log.Fatalf("Failed to insert into psqr: %v", err)
+		return fmt.Errorf("failed to insert into psqr: %w", err)
 	}
 
 	id, err := res.LastInsertId()
 	if err != nil {
-		log.Fatalf("Failed to get last insert ID: %v", err)
+		return fmt.Errorf("failed to get last insert ID: %w", err)
 	}
 
-	// Insert into connection
-	query = fmt.Sprintf("INSERT INTO connection (connectionOrigin, currentPsqr%dId) VALUES (?, ?)", int(perc*100))
-	_, err = tx.Exec(query, connection, id)
+	// Insert the connection if this is its first percentile
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO connection (connectionOrigin) SELECT ? WHERE NOT EXISTS (SELECT 1 FROM connection WHERE connectionOrigin = ?)",
+		connection, connection,
+	)
 	if err != nil {
-		log.Fatalf("Failed to insert into connection: %v", err)
+		return fmt.Errorf("failed to insert into connection: %w", err)
 	}
 
-	if err = tx.Commit(); err != nil {
-		log.Fatalf("Failed to commit transaction: %v", err)
+	// Link the connection to the new PSQR for this percentile. The WHERE clause is required
+	// by SQLite to parse the upsert clause of an INSERT ... SELECT.
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO connection_psqr (connectionId, perc, psqrId) SELECT id, ?, ? FROM connection WHERE connectionOrigin = ? ON CONFLICT (connectionId, perc) DO UPDATE SET psqrId = excluded.psqrId",
+		perc, id, connection,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert into connection_psqr: %w", err)
 	}
+
+	return nil
 }
 
+// UpdatePsqr updates an existing PSQR record.
 func UpdatePsqr(
+	ctx context.Context,
 	id int,
 	perc float64,
 	count int,
@@ -153,21 +426,27 @@ func UpdatePsqr(
 	n0, n1, n2, n3, n4 int,
 	np0, np1, np2, np3, np4 float64,
 	dn0, dn1, dn2, dn3, dn4 float64,
-) {
+) error {
 	InitSqlite()
 
-	_, err := dbInstance.Exec(
-		"UPDATE psqr SET perc = ?, count = ?, q0 = ?, q1 = ?, q2 = ?, q3 = ?, q4 = ?, n0 = ?, n1 = ?, n2 = ?, n3 = ?, n4 = ?, np0 = ?, np1 = ?, np2 = ?, np3 = ?, np4 = ?, dn0 = ?, dn1 = ?, dn2 = ?, dn3 = ?, dn4 = ? WHERE id = ?",
-		perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4, id,
-	)
+	err := retryBusy(ctx, func() error {
+		_, err := dbInstance.ExecContext(ctx,
+			"UPDATE psqr SET perc = ?, count = ?, q0 = ?, q1 = ?, q2 = ?, q3 = ?, q4 = ?, n0 = ?, n1 = ?, n2 = ?, n3 = ?, n4 = ?, np0 = ?, np1 = ?, np2 = ?, np3 = ?, np4 = ?, dn0 = ?, dn1 = ?, dn2 = ?, dn3 = ?, dn4 = ? WHERE id = ?",
+			perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4, id,
+		)
+		return err
+	})
 	if err != nil {
-		log.Fatalf("Failed to update psqr: %v", err)
+		return fmt.Errorf("failed to update psqr: %w", err)
 	}
+
+	return nil
 }
 
-// UpdatePsqr updates an existing PSQR record.
+// UpdatePsqrWithTx updates an existing PSQR record.
 // It accepts a transaction to ensure operations are part of a larger atomic action.
 func UpdatePsqrWithTx(
+	ctx context.Context,
 	tx *sql.Tx,
 	id int,
 	perc float64,
@@ -176,229 +455,335 @@ func UpdatePsqrWithTx(
 	n0, n1, n2, n3, n4 int,
 	np0, np1, np2, np3, np4 float64,
 	dn0, dn1, dn2, dn3, dn4 float64,
-) {
-	_, err := tx.Exec(
+) error {
+	_, err := tx.ExecContext(ctx,
 		"UPDATE psqr SET perc = ?, count = ?, q0 = ?, q1 = ?, q2 = ?, q3 = ?, q4 = ?, n0 = ?, n1 = ?, n2 = ?, n3 = ?, n4 = ?, np0 = ?, np1 = ?, np2 = ?, np3 = ?, np4 = ?, dn0 = ?, dn1 = ?, dn2 = ?, dn3 = ?, dn4 = ? WHERE id = ?",
 		perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4, id,
 	)
 	if err != nil {
-		log.Fatalf("Failed to update psqr: %v", err)
+		return fmt.Errorf("failed to update psqr: %w", err)
 	}
+
+	return nil
 }
 
 // SetNewPsqr sets a new PSQR for a given connection.
 // It uses the persistent dbInstance and handles concurrency appropriately.
-func SetNewPsqr(connection string, id int, perc float64) int {
+func SetNewPsqr(ctx context.Context, connection string, id int, perc float64) (int, error) {
 	InitSqlite()
 
-	_, err := dbInstance.Exec(
-		fmt.Sprintf("UPDATE connection SET currentPsqr%dId = ? WHERE connectionOrigin = ?", int(perc*100)),
-		id, connection,
-	)
+	err := retryBusy(ctx, func() error {
+		_, err := dbInstance.ExecContext(ctx, setCurrentPsqrIdQuery, id, perc, connection)
+		return err
+	})
 	if err != nil {
-		log.Fatalf("Failed to set new PSQR: %v", err)
+		return 0, fmt.Errorf("failed to set new PSQR: %w", err)
 	}
 
-	return id
+	return id, nil
 }
 
 // SetPreviousPsqr sets the previous PSQR ID for a given PSQR record.
 // It uses the persistent dbInstance and handles concurrency appropriately.
-func SetPreviousPsqr(newCurrentId int, oldCurrentId int) int {
+func SetPreviousPsqr(ctx context.Context, newCurrentId int, oldCurrentId int) (int, error) {
 	InitSqlite()
 
-	_, err := dbInstance.Exec("UPDATE psqr SET previousPsqrId = ? WHERE id = ?", oldCurrentId, newCurrentId)
+	err := retryBusy(ctx, func() error {
+		_, err := dbInstance.ExecContext(ctx, "UPDATE psqr SET previousPsqrId = ? WHERE id = ?", oldCurrentId, newCurrentId)
+		return err
+	})
 	if err != nil {
-		log.Fatalf("Failed to set previous PSQR: %v", err)
+		return 0, fmt.Errorf("failed to set previous PSQR: %w", err)
 	}
 
-	return newCurrentId
+	return newCurrentId, nil
 }
 
 // GetPsqr retrieves a PSQR record by its ID.
-// It uses the persistent dbInstance and handles concurrency appropriately.
-func GetPsqr(id int) (int, any, float64, int, [5]float64, [5]int, [5]float64, [5]float64) {
+// It reads through the read pool, concurrently with writes.
+// An error matching ErrPsqrNotFound is returned when no PSQR with the ID exists.
+func GetPsqr(ctx context.Context, id int) (PsqrRecord, error) {
 	InitSqlite()
 
-	// Define variables to hold the data
-	var foundId int
-	var previousPsqrId any
-	var foundPerc float64
-	var count int
-	var q [5]float64
-	var n [5]int
-	var np [5]float64
-	var dn [5]float64
-
-	// Query the psqr table
-	row := dbInstance.QueryRow("SELECT id, previousPsqrId, perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4 FROM psqr WHERE id = ?", id)
-	err := row.Scan(
-		&foundId,
-		&previousPsqrId,
-		&foundPerc,
-		&count,
-		&q[0], &q[1], &q[2], &q[3], &q[4],
-		&n[0], &n[1], &n[2], &n[3], &n[4],
-		&np[0], &np[1], &np[2], &np[3], &np[4],
-		&dn[0], &dn[1], &dn[2], &dn[3], &dn[4],
-	)
+	record, err := scanPsqr(readInstance.QueryRowContext(ctx, selectPsqrQuery, id))
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return 0, nil, 0, 0, [5]float64{}, [5]int{}, [5]float64{}, [5]float64{}
-		}
-		log.Fatalf("Failed to get psqr: %v", err)
+		return PsqrRecord{}, fmt.Errorf("failed to get psqr: %w", err)
 	}
 
-	return foundId, previousPsqrId, foundPerc, count, q, n, np, dn
+	return record, nil
 }
 
 // GetPsqrFromConnection retrieves the PSQR associated with a given connection and percentage.
-// It uses the persistent dbInstance and handles concurrency appropriately.
-func GetPsqrFromConnection(
-	connection string,
-	perc float64,
-) (int, any, float64, int, [5]float64, [5]int, [5]float64, [5]float64) {
+// It reads through the read pool, concurrently with writes.
+// An error matching ErrPsqrNotFound is returned when the connection has no PSQR for the percentage.
+func GetPsqrFromConnection(ctx context.Context, connection string, perc float64) (PsqrRecord, error) {
 	InitSqlite()
 
 	var psqrId int
-	query := fmt.Sprintf("SELECT currentPsqr%dId FROM connection WHERE connectionOrigin = ?", int(perc*100))
-	err := dbInstance.QueryRow(query, connection).Scan(&psqrId)
+	err := readInstance.QueryRowContext(ctx, currentPsqrIdQuery, connection, perc).Scan(&psqrId)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return 0, nil, 0, 0, [5]float64{}, [5]int{}, [5]float64{}, [5]float64{}
+			if logger.Enabled(ctx, slog.LevelDebug) {
+				logOtherPercentiles(ctx, connection, perc)
+			}
+			return PsqrRecord{}, fmt.Errorf("no PSQR for connection %s at percentile %v: %w", connection, perc, ErrPsqrNotFound)
 		}
-		log.Fatalf("Failed to get PSQR from connection: %v", err)
+		return PsqrRecord{}, fmt.Errorf("failed to get PSQR from connection: %w", err)
+	}
+
+	return GetPsqr(ctx, psqrId)
+}
+
+// logOtherPercentiles logs the percentiles a connection without a PSQR for perc does have PSQRs for. A missing
+// PSQR is the normal cold start of a connection, so this only runs when debug logging is enabled. The caller
+// then usually starts from scratch, which means the percentile a connection is classified at differs from the
+// one its data was stored at.
+func logOtherPercentiles(ctx context.Context, connection string, perc float64) {
+	percentiles, err := ListPercentiles(ctx, connection)
+	if err != nil || len(percentiles) == 0 {
+		return
 	}
 
-	return GetPsqr(psqrId)
+	logger.DebugContext(ctx, "no PSQR stored for percentile, but for others",
+		slog.String("connection", connection),
+		slog.Float64("percentile", perc),
+		slog.Any("stored_percentiles", percentiles),
+	)
 }
 
 // CreatePsqr inserts a new PSQR record and returns its ID.
 // It uses the persistent dbInstance and handles concurrency appropriately.
 func CreatePsqr(
+	ctx context.Context,
 	perc float64,
 	count int,
 	q0, q1, q2, q3, q4 float64,
 	n0, n1, n2, n3, n4 int,
 	np0, np1, np2, np3, np4 float64,
 	dn0, dn1, dn2, dn3, dn4 float64,
-) int {
+) (int, error) {
 	InitSqlite()
 
-	res, err := dbInstance.Exec(
-		"INSERT INTO psqr (perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
-		perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4,
-	)
+	var res sql.Result
+	err := retryBusy(ctx, func() (err error) {
+		res, err = dbInstance.ExecContext(ctx,
+			"INSERT INTO psqr (perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+			perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4,
+		)
+		return err
+	})
 	if err != nil {
-		log.Fatalf("Failed to create PSQR: %v", err)
+		return 0, fmt.Errorf("failed to create PSQR: %w", err)
 	}
 
 	id, err := res.LastInsertId()
 	if err != nil {
-		log.Fatalf("Failed to get last insert ID for PSQR: %v", err)
+		return 0, fmt.Errorf("failed to get last insert ID for PSQR: %w", err)
 	}
 
-	return int(id)
+	return int(id), nil
 }
 
 // SwapPsqr creates a new PSQR, updates the connection to point to the new PSQR,
 // sets the previous PSQR, and deletes the old PSQR if necessary.
-// It uses transactions to ensure atomicity.
-func SwapPsqr(connection string, perc float64) int {
+// It uses transactions to ensure atomicity. It returns -1 when the connection has no PSQR to swap.
+func SwapPsqr(ctx context.Context, connection string, perc float64) (int, error) {
+	// Keep the new PSQR and the one it replaces for blending
+	return swapPsqr(ctx, connection, perc, 2)
+}
+
+// SwapPsqrRetain swaps the PSQR like SwapPsqr but retains the history of previous windows
+// for auditing and debugging. The last keep windows, including the new one, are kept and
+// older ones are pruned. A keep of 0 or less retains the full history.
+func SwapPsqrRetain(ctx context.Context, connection string, perc float64, keep int) (int, error) {
+	return swapPsqr(ctx, connection, perc, keep)
+}
+
+func swapPsqr(ctx context.Context, connection string, perc float64, keep int) (int, error) {
+	var newId int
+	err := retryBusy(ctx, func() error {
+		var err error
+		newId, err = swapPsqrOnce(ctx, connection, perc, keep)
+		return err
+	})
+
+	return newId, err
+}
+
+func swapPsqrOnce(ctx context.Context, connection string, perc float64, keep int) (int, error) {
 	InitSqlite()
 
 	// Start a transaction
-	tx, err := dbInstance.Begin()
+	tx, err := dbInstance.BeginTx(ctx, nil)
 	if err != nil {
-		log.Fatalf("Failed to begin transaction: %v", err)
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	// Get the current PSQR from the connection
-	id, previousId, currentPerc, _, q, n, np, dn := GetPsqrFromConnectionTransactional(tx, connection, perc)
+	newId, err := swapPsqrTransactional(ctx, tx, connection, perc, keep)
+	if err != nil || newId == -1 {
+		return newId, err
+	}
 
-	if currentPerc == 0 {
-		return -1
+	// Commit the transaction
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return newId, nil
+}
+
+// swapPsqrTransactional swaps the current PSQR of a connection within a transaction, see SwapPsqrRetain.
+// It returns -1 when the connection has no PSQR to swap.
+func swapPsqrTransactional(ctx context.Context, tx *sql.Tx, connection string, perc float64, keep int) (int, error) {
+	// Get the current PSQR from the connection
+	current, err := GetPsqrFromConnectionTransactional(ctx, tx, connection, perc)
+	if errors.Is(err, ErrPsqrNotFound) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
 	}
 
 	// Create a new PSQR
-	newId := CreatePsqrTransactional(tx, currentPerc, 0, q, n, np, dn)
+	newId, err := CreatePsqrTransactional(ctx, tx, current.Perc, 0, current.Q, current.N, current.Np, current.Dn)
+	if err != nil {
+		return 0, err
+	}
 
 	// Update the connection to point to the new PSQR
-	SetNewPsqrTransactional(tx, connection, newId, currentPerc)
+	if err = SetNewPsqrTransactional(ctx, tx, connection, newId, current.Perc); err != nil {
+		return 0, err
+	}
 
 	// Set the previous PSQR of the new PSQR to the old PSQR
-	SetPreviousPsqrTransactional(tx, newId, id)
+	if err = SetPreviousPsqrTransactional(ctx, tx, newId, current.ID); err != nil {
+		return 0, err
+	}
 
-	// Delete the old PSQR if it exists
-	if previousId != nil {
-		_, err = tx.Exec("DELETE FROM psqr WHERE id = ?", previousId)
-		if err != nil {
-			log.Fatalf("Failed to delete previous PSQR: %v", err)
+	// Delete the PSQRs beyond the retention limit
+	if keep > 0 {
+		if err = PrunePsqrHistoryTransactional(ctx, tx, newId, keep); err != nil {
+			return 0, err
 		}
 	}
 
-	// Commit the transaction
+	return newId, nil
+}
+
+// FlushPsqr persists the outcome of many updates of a connection's PSQR at once, in a single transaction.
+// When swapped is set the current PSQR is overwritten with it and swapped out like SwapPsqr does, so it becomes
+// the previous PSQR. The current PSQR is then overwritten with current, or inserted when there is none.
+// Either may be nil to leave it out.
+func FlushPsqr(ctx context.Context, swapped *PsqrState, current *PsqrState) error {
+	return retryBusy(ctx, func() error {
+		return flushPsqr(ctx, swapped, current)
+	})
+}
+
+func flushPsqr(ctx context.Context, swapped *PsqrState, current *PsqrState) error {
+	InitSqlite()
+
+	tx, err := dbInstance.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if swapped != nil {
+		if err := upsertCurrentPsqrTransactional(ctx, tx, *swapped); err != nil {
+			return err
+		}
+		// Keep the new PSQR and the one it replaces for blending, like SwapPsqr
+		if _, err := swapPsqrTransactional(ctx, tx, swapped.Connection, swapped.Perc, 2); err != nil {
+			return err
+		}
+	}
+
+	if current != nil {
+		if err := upsertCurrentPsqrTransactional(ctx, tx, *current); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// PrunePsqrHistory deletes the PSQRs of a connection's percentile beyond the last keep windows,
+// including the current one.
+func PrunePsqrHistory(ctx context.Context, connection string, perc float64, keep int) error {
+	return retryBusy(ctx, func() error {
+		return prunePsqrHistory(ctx, connection, perc, keep)
+	})
+}
+
+func prunePsqrHistory(ctx context.Context, connection string, perc float64, keep int) error {
+	InitSqlite()
+
+	if keep < 1 {
+		return fmt.Errorf("keep must be at least 1, got %d", keep)
+	}
+
+	tx, err := dbInstance.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var psqrId int
+	err = tx.QueryRowContext(ctx, currentPsqrIdQuery, connection, perc).Scan(&psqrId)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get PSQR from connection: %w", err)
+	}
+
+	if err = PrunePsqrHistoryTransactional(ctx, tx, psqrId, keep); err != nil {
+		return err
+	}
+
 	if err = tx.Commit(); err != nil {
-		log.Fatalf("Failed to commit transaction: %v", err)
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return newId
+	return nil
 }
 
 // Below are helper functions that operate within a transaction.
 // These ensure that operations are atomic and reduce lock contention.
 
 // GetPsqrFromConnectionTransactional retrieves the PSQR within a transaction.
-func GetPsqrFromConnectionTransactional(tx *sql.Tx, connection string, perc float64) (int, any, float64, int, [5]float64, [5]int, [5]float64, [5]float64) {
+// An error matching ErrPsqrNotFound is returned when the connection has no PSQR for the percentage.
+func GetPsqrFromConnectionTransactional(ctx context.Context, tx *sql.Tx, connection string, perc float64) (PsqrRecord, error) {
 	var psqrId int
-	query := fmt.Sprintf("SELECT currentPsqr%dId FROM connection WHERE connectionOrigin = ?", int(perc*100))
-	err := tx.QueryRow(query, connection).Scan(&psqrId)
+	err := tx.QueryRowContext(ctx, currentPsqrIdQuery, connection, perc).Scan(&psqrId)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return 0, nil, 0, 0, [5]float64{}, [5]int{}, [5]float64{}, [5]float64{}
+			return PsqrRecord{}, fmt.Errorf("no PSQR for connection %s at percentile %v: %w", connection, perc, ErrPsqrNotFound)
 		}
-		log.Fatalf("Failed to get PSQR from connection within transaction: %v", err)
+		return PsqrRecord{}, fmt.Errorf("failed to get PSQR from connection within transaction: %w", err)
 	}
 
-	return GetPsqrTransactional(tx, psqrId)
+	return GetPsqrTransactional(ctx, tx, psqrId)
 }
 
 // GetPsqrTransactional retrieves a PSQR within a transaction.
-func GetPsqrTransactional(tx *sql.Tx, id int) (int, any, float64, int, [5]float64, [5]int, [5]float64, [5]float64) {
-	var foundId int
-	var previousPsqrId any
-	var foundPerc float64
-	var count int
-	var q [5]float64
-	var n [5]int
-	var np [5]float64
-	var dn [5]float64
-
-	row := tx.QueryRow("SELECT id, previousPsqrId, perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4 FROM psqr WHERE id = ?", id)
-	err := row.Scan(
-		&foundId,
-		&previousPsqrId,
-		&foundPerc,
-		&count,
-		&q[0], &q[1], &q[2], &q[3], &q[4],
-		&n[0], &n[1], &n[2], &n[3], &n[4],
-		&np[0], &np[1], &np[2], &np[3], &np[4],
-		&dn[0], &dn[1], &dn[2], &dn[3], &dn[4],
-	)
+func GetPsqrTransactional(ctx context.Context, tx *sql.Tx, id int) (PsqrRecord, error) {
+	record, err := scanPsqr(tx.QueryRowContext(ctx, selectPsqrQuery, id))
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return 0, nil, 0, 0, [5]float64{}, [5]int{}, [5]float64{}, [5]float64{}
-		}
-		log.Fatalf("Failed to get PSQR within transaction: %v", err)
+		return PsqrRecord{}, fmt.Errorf("failed to get PSQR within transaction: %w", err)
 	}
 
-	return foundId, previousPsqrId, foundPerc, count, q, n, np, dn
+	return record, nil
 }
 
 // CreatePsqrTransactional creates a PSQR within a transaction.
-func CreatePsqrTransactional(tx *sql.Tx, perc float64, count int, q [5]float64, n [5]int, np [5]float64, dn [5]float64) int {
-	res, err := tx.Exec(
+func CreatePsqrTransactional(ctx context.Context, tx *sql.Tx, perc float64, count int, q [5]float64, n [5]int, np [5]float64, dn [5]float64) (int, error) {
+	res, err := tx.ExecContext(ctx,
 		"INSERT INTO psqr (perc, count, q0, q1, q2, q3, q4, n0, n1, n2, n3, n4, np0, np1, np2, np3, np4, dn0, dn1, dn2, dn3, dn4) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
 		perc, count, q[0], q[1], q[2], q[3], q[4],
 		n[0], n[1], n[2], n[3], n[4],
@@ -406,32 +791,244 @@ func CreatePsqrTransactional(tx *sql.Tx, perc float64, count int, q [5]float64,
 		dn[0], dn[1], dn[2], dn[3], dn[4],
 	)
 	if err != nil {
-		log.Fatalf("Failed to create PSQR within transaction: %v", err)
+		return 0, fmt.Errorf("failed to create PSQR within transaction: %w", err)
 	}
 
 	id, err := res.LastInsertId()
 	if err != nil {
-		log.Fatalf("Failed to get last insert ID for PSQR within transaction: %v", err)
+		return 0, fmt.Errorf("failed to get last insert ID for PSQR within transaction: %w", err)
 	}
 
-	return int(id)
+	return int(id), nil
 }
 
 // SetNewPsqrTransactional sets a new PSQR within a transaction.
-func SetNewPsqrTransactional(tx *sql.Tx, connection string, id int, perc float64) {
-	_, err := tx.Exec(
-		fmt.Sprintf("UPDATE connection SET currentPsqr%dId = ? WHERE connectionOrigin = ?", int(perc*100)),
-		id, connection,
-	)
+func SetNewPsqrTransactional(ctx context.Context, tx *sql.Tx, connection string, id int, perc float64) error {
+	_, err := tx.ExecContext(ctx, setCurrentPsqrIdQuery, id, perc, connection)
 	if err != nil {
-		log.Fatalf("Failed to set new PSQR within transaction: %v", err)
+		return fmt.Errorf("failed to set new PSQR within transaction: %w", err)
 	}
+
+	return nil
 }
 
 // SetPreviousPsqrTransactional sets the previous PSQR within a transaction.
-func SetPreviousPsqrTransactional(tx *sql.Tx, newCurrentId int, oldCurrentId int) {
-	_, err := tx.Exec("UPDATE psqr SET previousPsqrId = ? WHERE id = ?", oldCurrentId, newCurrentId)
+func SetPreviousPsqrTransactional(ctx context.Context, tx *sql.Tx, newCurrentId int, oldCurrentId int) error {
+	_, err := tx.ExecContext(ctx, "UPDATE psqr SET previousPsqrId = ? WHERE id = ?", oldCurrentId, newCurrentId)
 	if err != nil {
-		log.Fatalf("Failed to set previous PSQR within transaction: %v", err)
+		return fmt.Errorf("failed to set previous PSQR within transaction: %w", err)
 	}
+
+	return nil
+}
+
+// PrunePsqrHistoryTransactional deletes the PSQRs more than keep steps down the previousPsqrId chain
+// starting at psqrId within a transaction. The oldest retained PSQR no longer points to a previous one.
+func PrunePsqrHistoryTransactional(ctx context.Context, tx *sql.Tx, psqrId int, keep int) error {
+	const chain = `
+		WITH RECURSIVE chain(id, depth) AS (
+			SELECT ?, 1
+			UNION ALL
+			SELECT p.previousPsqrId, chain.depth + 1 FROM psqr p JOIN chain ON p.id = chain.id WHERE p.previousPsqrId IS NOT NULL
+		)`
+
+	_, err := tx.ExecContext(ctx, chain+" DELETE FROM psqr WHERE id IN (SELECT id FROM chain WHERE depth > ?)", psqrId, keep)
+	if err != nil {
+		return fmt.Errorf("failed to prune PSQR history within transaction: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, chain+" UPDATE psqr SET previousPsqrId = NULL WHERE id IN (SELECT id FROM chain WHERE depth = ?)", psqrId, keep)
+	if err != nil {
+		return fmt.Errorf("failed to unlink pruned PSQR history within transaction: %w", err)
+	}
+
+	return nil
+}
+
+// ListConnections returns the distinct connection origins that have stored PSQR data.
+func ListConnections(ctx context.Context) ([]string, error) {
+	InitSqlite()
+
+	rows, err := readInstance.QueryContext(ctx, "SELECT DISTINCT connectionOrigin FROM connection ORDER BY connectionOrigin")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list connections: %w", err)
+	}
+	defer rows.Close()
+
+	connections := []string{}
+	for rows.Next() {
+		var connection string
+		if err := rows.Scan(&connection); err != nil {
+			return nil, fmt.Errorf("failed to scan connection: %w", err)
+		}
+		connections = append(connections, connection)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list connections: %w", err)
+	}
+
+	return connections, nil
+}
+
+// ListPercentiles returns the percentiles a connection has a current PSQR for, in ascending order.
+func ListPercentiles(ctx context.Context, connection string) ([]float64, error) {
+	InitSqlite()
+
+	rows, err := readInstance.QueryContext(ctx, "SELECT cp.perc FROM connection_psqr cp JOIN connection c ON c.id = cp.connectionId WHERE c.connectionOrigin = ? ORDER BY cp.perc", connection)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list percentiles: %w", err)
+	}
+	defer rows.Close()
+
+	percentiles := []float64{}
+	for rows.Next() {
+		var perc float64
+		if err := rows.Scan(&perc); err != nil {
+			return nil, fmt.Errorf("failed to scan percentile: %w", err)
+		}
+		percentiles = append(percentiles, perc)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list percentiles: %w", err)
+	}
+
+	return percentiles, nil
+}
+
+// RenameConnection moves the PSQRs and the score history of a connection to a new name in a single
+// transaction, for instance when a service moved to a new host. It returns an error matching
+// ErrConnectionExists when newConnection already has PSQRs or score history, and one matching
+// ErrConnectionNotFound when oldConnection has neither.
+func RenameConnection(ctx context.Context, oldConnection string, newConnection string) error {
+	return retryBusy(ctx, func() error {
+		return renameConnection(ctx, oldConnection, newConnection)
+	})
+}
+
+func renameConnection(ctx context.Context, oldConnection string, newConnection string) error {
+	InitSqlite()
+
+	tx, err := dbInstance.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	const existsQuery = "SELECT EXISTS (SELECT 1 FROM connection WHERE connectionOrigin = ?) OR EXISTS (SELECT 1 FROM score_history WHERE connectionOrigin = ?)"
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, existsQuery, newConnection, newConnection).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check connection %s: %w", newConnection, err)
+	}
+	if exists {
+		return fmt.Errorf("connection %s: %w", newConnection, ErrConnectionExists)
+	}
+
+	if err := tx.QueryRowContext(ctx, existsQuery, oldConnection, oldConnection).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check connection %s: %w", oldConnection, err)
+	}
+	if !exists {
+		return fmt.Errorf("connection %s: %w", oldConnection, ErrConnectionNotFound)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE connection SET connectionOrigin = ? WHERE connectionOrigin = ?", newConnection, oldConnection); err != nil {
+		return fmt.Errorf("failed to rename connection: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE score_history SET connectionOrigin = ? WHERE connectionOrigin = ?", newConnection, oldConnection); err != nil {
+		return fmt.Errorf("failed to rename score history: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteConnection removes a connection together with all of its PSQR rows and its score history.
+// The previousPsqrId chain of every percentile is followed so no orphaned
+// PSQR rows remain. All deletes happen in a single transaction.
+func DeleteConnection(ctx context.Context, connection string) error {
+	return retryBusy(ctx, func() error {
+		return deleteConnection(ctx, connection)
+	})
+}
+
+func deleteConnection(ctx context.Context, connection string) error {
+	InitSqlite()
+
+	tx, err := dbInstance.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Delete the current PSQRs and every PSQR reachable through previousPsqrId
+	_, err = tx.ExecContext(ctx, `
+		WITH RECURSIVE chain(id) AS (
+			SELECT cp.psqrId FROM connection_psqr cp JOIN connection c ON c.id = cp.connectionId WHERE c.connectionOrigin = ?
+			UNION
+			SELECT p.previousPsqrId FROM psqr p JOIN chain ON p.id = chain.id WHERE p.previousPsqrId IS NOT NULL
+		)
+		DELETE FROM psqr WHERE id IN (SELECT id FROM chain)`,
+		connection,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete PSQRs of connection %s: %w", connection, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM connection_psqr WHERE connectionId IN (SELECT id FROM connection WHERE connectionOrigin = ?)", connection)
+	if err != nil {
+		return fmt.Errorf("failed to delete connection_psqr rows of connection %s: %w", connection, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM connection WHERE connectionOrigin = ?", connection)
+	if err != nil {
+		return fmt.Errorf("failed to delete connection %s: %w", connection, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM score_history WHERE connectionOrigin = ?", connection)
+	if err != nil {
+		return fmt.Errorf("failed to delete score history of connection %s: %w", connection, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// TruncateAll deletes every connection, PSQR and recorded score in a single transaction.
+// Applied migrations are kept, so the schema stays in place.
+func TruncateAll(ctx context.Context) error {
+	return retryBusy(ctx, func() error {
+		return truncateAll(ctx)
+	})
+}
+
+func truncateAll(ctx context.Context) error {
+	InitSqlite()
+
+	tx, err := dbInstance.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Delete the links first so no row points at a deleted one
+	for _, table := range []string{"connection_psqr", "connection", "psqr", "score_history"} {
+		if _, err = tx.ExecContext(ctx, "DELETE FROM "+table); err != nil {
+			return fmt.Errorf("failed to truncate %s: %w", table, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
 }
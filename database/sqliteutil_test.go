@@ -0,0 +1,612 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useDatabase opens the database at path for the rest of the test, closing it and restoring the default
+// configuration when the test ends.
+func useDatabase(t *testing.T, path string) {
+	t.Helper()
+
+	if err := Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	cfg := DefaultSqliteConfig()
+	cfg.Path = path
+	if err := SetSqliteConfig(cfg); err != nil {
+		t.Fatalf("SetSqliteConfig(%q) error = %v", path, err)
+	}
+
+	t.Cleanup(func() {
+		if err := Close(); err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+		if err := SetSqliteConfig(DefaultSqliteConfig()); err != nil {
+			t.Errorf("SetSqliteConfig() error = %v", err)
+		}
+	})
+}
+
+// openTestDatabase opens a migrated database in a temporary directory for the rest of the test.
+func openTestDatabase(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "classifierData.db")
+	useDatabase(t, path)
+	Migrate()
+
+	return path
+}
+
+// insertTestPsqr stores a current PSQR with the given count for a connection.
+func insertTestPsqr(t *testing.T, connection string, perc float64, count int) {
+	t.Helper()
+
+	err := InsertConnectionWithPsqr(context.Background(), connection, perc, count,
+		10, 20, 30, 40, 50,
+		1, 2, 3, 4, 5,
+		1, 1+2*perc, 1+4*perc, 3+2*perc, 5,
+		0, perc/2, perc, (1+perc)/2, 1,
+	)
+	if err != nil {
+		t.Fatalf("InsertConnectionWithPsqr(%q) error = %v", connection, err)
+	}
+}
+
+func TestCloseReopensOnNewPath(t *testing.T) {
+	ctx := context.Background()
+
+	first := openTestDatabase(t)
+	insertTestPsqr(t, "first", 0.95, 5)
+
+	if err := Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	// Closing twice does nothing
+	if err := Close(); err != nil {
+		t.Fatalf("second Close() error = %v", err)
+	}
+
+	cfg := DefaultSqliteConfig()
+	cfg.Path = filepath.Join(t.TempDir(), "second.db")
+	if err := SetSqliteConfig(cfg); err != nil {
+		t.Fatalf("SetSqliteConfig() error = %v", err)
+	}
+	Migrate()
+
+	connections, err := ListConnections(ctx)
+	if err != nil {
+		t.Fatalf("ListConnections() error = %v", err)
+	}
+	if len(connections) != 0 {
+		t.Errorf("ListConnections() on the new database = %v, want none", connections)
+	}
+
+	// The open database can't be reconfigured
+	if err := SetSqliteConfig(cfg); err == nil {
+		t.Error("SetSqliteConfig() on an open database succeeded, want an error")
+	}
+
+	if err := Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	cfg.Path = first
+	if err := SetSqliteConfig(cfg); err != nil {
+		t.Fatalf("SetSqliteConfig() error = %v", err)
+	}
+
+	connections, err = ListConnections(ctx)
+	if err != nil {
+		t.Fatalf("ListConnections() error = %v", err)
+	}
+	if !slices.Equal(connections, []string{"first"}) {
+		t.Errorf("ListConnections() on the first database = %v, want [first]", connections)
+	}
+}
+
+func TestDeleteConnectionDeletesScoreHistory(t *testing.T) {
+	ctx := context.Background()
+	openTestDatabase(t)
+
+	for _, connection := range []string{"deleted", "kept"} {
+		insertTestPsqr(t, connection, 0.95, 5)
+		if err := InsertScore(ctx, connection, time.UnixMilli(1000), 0.5); err != nil {
+			t.Fatalf("InsertScore(%q) error = %v", connection, err)
+		}
+	}
+
+	if err := DeleteConnection(ctx, "deleted"); err != nil {
+		t.Fatalf("DeleteConnection() error = %v", err)
+	}
+
+	if points, err := GetScoreHistory(ctx, "deleted", time.Time{}); err != nil || len(points) != 0 {
+		t.Errorf("GetScoreHistory() of the deleted connection = %v, %v, want no scores", points, err)
+	}
+	if points, err := GetScoreHistory(ctx, "kept", time.Time{}); err != nil || len(points) != 1 {
+		t.Errorf("GetScoreHistory() of the kept connection = %v, %v, want one score", points, err)
+	}
+
+	// The name of the deleted connection is free again
+	if err := RenameConnection(ctx, "kept", "deleted"); err != nil {
+		t.Errorf("RenameConnection() onto a deleted connection error = %v", err)
+	}
+}
+
+func TestTruncateAllDeletesScoreHistory(t *testing.T) {
+	ctx := context.Background()
+	openTestDatabase(t)
+
+	insertTestPsqr(t, "truncated", 0.95, 5)
+	if err := InsertScore(ctx, "truncated", time.UnixMilli(1000), 0.5); err != nil {
+		t.Fatalf("InsertScore() error = %v", err)
+	}
+
+	if err := TruncateAll(ctx); err != nil {
+		t.Fatalf("TruncateAll() error = %v", err)
+	}
+
+	if got := countRows(t, "score_history"); got != 0 {
+		t.Errorf("score_history rows after TruncateAll() = %d, want 0", got)
+	}
+
+	insertTestPsqr(t, "other", 0.95, 5)
+	if err := RenameConnection(ctx, "other", "truncated"); err != nil {
+		t.Errorf("RenameConnection() onto a truncated connection error = %v", err)
+	}
+}
+
+func TestGetPsqrFromConnectionNotFound(t *testing.T) {
+	openTestDatabase(t)
+	insertTestPsqr(t, "other-percentile", 0.95, 10)
+
+	var logs bytes.Buffer
+	SetLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { SetLogger(nil) })
+
+	for _, connection := range []string{"unknown", "other-percentile"} {
+		_, err := GetPsqrFromConnection(context.Background(), connection, 0.99)
+		if !errors.Is(err, ErrPsqrNotFound) {
+			t.Errorf("GetPsqrFromConnection(%q) error = %v, want one matching ErrPsqrNotFound", connection, err)
+		}
+	}
+
+	// A cold start isn't worth a warning, the stored percentiles are only looked up for the debug log
+	if strings.Contains(logs.String(), "level=WARN") {
+		t.Errorf("logs = %q, want no warnings", logs.String())
+	}
+	if !strings.Contains(logs.String(), "level=DEBUG") || !strings.Contains(logs.String(), "stored_percentiles=[0.95]") {
+		t.Errorf("logs = %q, want a debug log with the stored percentiles", logs.String())
+	}
+	if strings.Count(logs.String(), "\n") != 1 {
+		t.Errorf("logs = %q, want only a log for the connection with other percentiles", logs.String())
+	}
+}
+
+func TestErrorsMatchSentinels(t *testing.T) {
+	ctx := context.Background()
+	openTestDatabase(t)
+	insertTestPsqr(t, "first", 0.95, 10)
+	insertTestPsqr(t, "second", 0.95, 10)
+
+	// ErrBusy is matched by TestRetryBusyGivesUpWithErrBusy, it takes a locked database
+	sentinels := []error{ErrPsqrNotFound, ErrConnectionNotFound, ErrConnectionExists, ErrBusy}
+	for _, tt := range []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{name: "GetPsqr of an unknown id", want: ErrPsqrNotFound, call: func() error {
+			_, err := GetPsqr(ctx, 1_000_000)
+			return err
+		}},
+		{name: "GetPsqrFromConnection of an unknown connection", want: ErrPsqrNotFound, call: func() error {
+			_, err := GetPsqrFromConnection(ctx, "unknown", 0.95)
+			return err
+		}},
+		{name: "RenameConnection of an unknown connection", want: ErrConnectionNotFound, call: func() error {
+			return RenameConnection(ctx, "unknown", "renamed")
+		}},
+		{name: "RenameConnection onto an existing connection", want: ErrConnectionExists, call: func() error {
+			return RenameConnection(ctx, "first", "second")
+		}},
+	} {
+		err := tt.call()
+		for _, sentinel := range sentinels {
+			if got, want := errors.Is(err, sentinel), sentinel == tt.want; got != want {
+				t.Errorf("%s: errors.Is(%v, %v) = %v, want %v", tt.name, err, sentinel, got, want)
+			}
+		}
+	}
+}
+
+func TestPercentilesOfOneConnectionRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	openTestDatabase(t)
+
+	percentiles := []float64{0.5, 0.95, 0.99}
+	for i, perc := range percentiles {
+		insertTestPsqr(t, "multi", perc, 10+i)
+	}
+
+	for i, perc := range percentiles {
+		record, err := GetPsqrFromConnection(ctx, "multi", perc)
+		if err != nil {
+			t.Fatalf("GetPsqrFromConnection(%v) error = %v", perc, err)
+		}
+		if record.Perc != perc || record.Count != 10+i {
+			t.Errorf("GetPsqrFromConnection(%v) = perc %v with count %d, want perc %v with count %d", perc, record.Perc, record.Count, perc, 10+i)
+		}
+		if want := [5]float64{0, perc / 2, perc, (1 + perc) / 2, 1}; record.Dn != want {
+			t.Errorf("GetPsqrFromConnection(%v) increments = %v, want %v", perc, record.Dn, want)
+		}
+	}
+
+	got, err := ListPercentiles(ctx, "multi")
+	if err != nil {
+		t.Fatalf("ListPercentiles() error = %v", err)
+	}
+	if !slices.Equal(got, percentiles) {
+		t.Errorf("ListPercentiles() = %v, want %v", got, percentiles)
+	}
+}
+
+func TestDeleteConnectionDeletesPsqrChain(t *testing.T) {
+	ctx := context.Background()
+	openTestDatabase(t)
+
+	for _, connection := range []string{"c", "a", "b"} {
+		insertTestPsqr(t, connection, 0.95, 5)
+	}
+	if _, err := SwapPsqr(ctx, "b", 0.95); err != nil {
+		t.Fatalf("SwapPsqr() error = %v", err)
+	}
+
+	connections, err := ListConnections(ctx)
+	if err != nil {
+		t.Fatalf("ListConnections() error = %v", err)
+	}
+	if !slices.Equal(connections, []string{"a", "b", "c"}) {
+		t.Fatalf("ListConnections() = %v, want [a b c]", connections)
+	}
+
+	current, err := GetPsqrFromConnection(ctx, "b", 0.95)
+	if err != nil {
+		t.Fatalf("GetPsqrFromConnection() error = %v", err)
+	}
+	if current.PreviousID == nil {
+		t.Fatal("swapped PSQR has no previous PSQR")
+	}
+
+	if err := DeleteConnection(ctx, "b"); err != nil {
+		t.Fatalf("DeleteConnection() error = %v", err)
+	}
+
+	connections, err = ListConnections(ctx)
+	if err != nil {
+		t.Fatalf("ListConnections() error = %v", err)
+	}
+	if !slices.Equal(connections, []string{"a", "c"}) {
+		t.Errorf("ListConnections() after deleting b = %v, want [a c]", connections)
+	}
+
+	for _, id := range []int{current.ID, *current.PreviousID} {
+		if _, err := GetPsqr(ctx, id); !errors.Is(err, ErrPsqrNotFound) {
+			t.Errorf("GetPsqr(%d) of the deleted connection error = %v, want ErrPsqrNotFound", id, err)
+		}
+	}
+	if got := countRows(t, "psqr"); got != 2 {
+		t.Errorf("psqr rows after deleting b = %d, want the 2 of the other connections", got)
+	}
+}
+
+func TestCancelledContextFailsWithContextError(t *testing.T) {
+	openTestDatabase(t)
+	insertTestPsqr(t, "cancelled", 0.95, 5)
+
+	current, err := GetPsqrFromConnection(context.Background(), "cancelled", 0.95)
+	if err != nil {
+		t.Fatalf("GetPsqrFromConnection() error = %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+
+	for _, tt := range []struct {
+		ctx  context.Context
+		want error
+	}{
+		{ctx: cancelled, want: context.Canceled},
+		{ctx: expired, want: context.DeadlineExceeded},
+	} {
+		calls := map[string]func() error{
+			"GetPsqr": func() error {
+				_, err := GetPsqr(tt.ctx, current.ID)
+				return err
+			},
+			"GetPsqrFromConnection": func() error {
+				_, err := GetPsqrFromConnection(tt.ctx, "cancelled", 0.95)
+				return err
+			},
+			"InsertConnectionWithPsqr": func() error {
+				return InsertConnectionWithPsqr(tt.ctx, "inserted", 0.95, 5,
+					10, 20, 30, 40, 50, 1, 2, 3, 4, 5, 1, 2, 3, 4, 5, 0, 0.475, 0.95, 0.975, 1)
+			},
+			"UpdatePsqr": func() error {
+				return UpdatePsqr(tt.ctx, current.ID, 0.95, 6,
+					10, 20, 30, 40, 50, 1, 2, 3, 4, 6, 1, 2, 3, 4, 6, 0, 0.475, 0.95, 0.975, 1)
+			},
+			"SwapPsqr": func() error {
+				_, err := SwapPsqr(tt.ctx, "cancelled", 0.95)
+				return err
+			},
+		}
+
+		for name, call := range calls {
+			if err := call(); !errors.Is(err, tt.want) {
+				t.Errorf("%s() error = %v, want one matching %v", name, err, tt.want)
+			}
+		}
+	}
+
+	// Nothing was changed by the failed calls
+	after, err := GetPsqrFromConnection(context.Background(), "cancelled", 0.95)
+	if err != nil {
+		t.Fatalf("GetPsqrFromConnection() error = %v", err)
+	}
+	if after.ID != current.ID || after.Count != current.Count {
+		t.Errorf("PSQR after the failed calls = %+v, want %+v", after, current)
+	}
+	if connections, err := ListConnections(context.Background()); err != nil || !slices.Equal(connections, []string{"cancelled"}) {
+		t.Errorf("ListConnections() = %v, %v, want only the cancelled connection", connections, err)
+	}
+}
+
+func TestSwapPsqrRetainCapsChain(t *testing.T) {
+	ctx := context.Background()
+	openTestDatabase(t)
+	insertTestPsqr(t, "retained", 0.95, 5)
+
+	// chainLength follows previousPsqrId from the current PSQR of the connection
+	chainLength := func() int {
+		t.Helper()
+
+		record, err := GetPsqrFromConnection(ctx, "retained", 0.95)
+		if err != nil {
+			t.Fatalf("GetPsqrFromConnection() error = %v", err)
+		}
+
+		length := 1
+		for record.PreviousID != nil {
+			if record, err = GetPsqr(ctx, *record.PreviousID); err != nil {
+				t.Fatalf("GetPsqr() error = %v", err)
+			}
+			length++
+		}
+		return length
+	}
+
+	const keep = 3
+	for swap := 1; swap <= 5; swap++ {
+		if _, err := SwapPsqrRetain(ctx, "retained", 0.95, keep); err != nil {
+			t.Fatalf("SwapPsqrRetain() error = %v", err)
+		}
+
+		want := min(swap+1, keep)
+		if got := chainLength(); got != want {
+			t.Errorf("chain length after %d swaps = %d, want %d", swap, got, want)
+		}
+		if got := countRows(t, "psqr"); got != want {
+			t.Errorf("psqr rows after %d swaps = %d, want %d, pruned windows must be deleted", swap, got, want)
+		}
+	}
+
+	// Without a limit the full history is retained
+	for swap := 1; swap <= 2; swap++ {
+		if _, err := SwapPsqrRetain(ctx, "retained", 0.95, 0); err != nil {
+			t.Fatalf("SwapPsqrRetain() error = %v", err)
+		}
+	}
+	if got := chainLength(); got != keep+2 {
+		t.Errorf("chain length after swapping without a limit = %d, want %d", got, keep+2)
+	}
+}
+
+func TestInsertConnectionWithPsqrInsertsAndUpdates(t *testing.T) {
+	ctx := context.Background()
+	openTestDatabase(t)
+
+	// A new connection gets a connection row and a current PSQR
+	insertTestPsqr(t, "upserted", 0.95, 5)
+	inserted, err := GetPsqrFromConnection(ctx, "upserted", 0.95)
+	if err != nil {
+		t.Fatalf("GetPsqrFromConnection() after inserting error = %v", err)
+	}
+	if inserted.Count != 5 {
+		t.Errorf("count after inserting = %d, want 5", inserted.Count)
+	}
+
+	// An existing connection has its current PSQR updated in place
+	insertTestPsqr(t, "upserted", 0.95, 9)
+	updated, err := GetPsqrFromConnection(ctx, "upserted", 0.95)
+	if err != nil {
+		t.Fatalf("GetPsqrFromConnection() after updating error = %v", err)
+	}
+	if updated.ID != inserted.ID || updated.Count != 9 {
+		t.Errorf("PSQR after updating = id %d with count %d, want id %d with count 9", updated.ID, updated.Count, inserted.ID)
+	}
+
+	// A new percentile of an existing connection gets its own PSQR under the same connection
+	insertTestPsqr(t, "upserted", 0.5, 3)
+	if record, err := GetPsqrFromConnection(ctx, "upserted", 0.5); err != nil || record.Count != 3 || record.ID == inserted.ID {
+		t.Errorf("GetPsqrFromConnection() of the new percentile = %+v, %v, want a new PSQR with count 3", record, err)
+	}
+
+	for table, want := range map[string]int{"connection": 1, "connection_psqr": 2, "psqr": 2} {
+		if got := countRows(t, table); got != want {
+			t.Errorf("%s rows = %d, want %d", table, got, want)
+		}
+	}
+}
+
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	ctx := context.Background()
+	openTestDatabase(t)
+	SetMaxOpenConns(8)
+
+	const writers, readers, writes = 4, 8, 50
+	connection := func(w int) string { return fmt.Sprintf("concurrent-%d", w) }
+	for w := 0; w < writers; w++ {
+		insertTestPsqr(t, connection(w), 0.95, 0)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers+readers)
+	stop := make(chan struct{})
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 1; i <= writes; i++ {
+				err := InsertConnectionWithPsqr(ctx, connection(w), 0.95, i,
+					10, 20, 30, 40, 50, 1, 2, 3, 4, 5, 1, 2, 3, 4, 5, 0, 0.475, 0.95, 0.975, 1)
+				if err != nil {
+					errs <- fmt.Errorf("InsertConnectionWithPsqr(%s) error = %w", connection(w), err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	// Every reader sees the count of a connection grow, it never reads a torn or older write
+	var readersWg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		readersWg.Add(1)
+		go func(r int) {
+			defer readersWg.Done()
+
+			last := 0
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				record, err := GetPsqrFromConnection(ctx, connection(r%writers), 0.95)
+				if err != nil {
+					errs <- fmt.Errorf("GetPsqrFromConnection() error = %w", err)
+					return
+				}
+				if record.Count < last || record.Count > writes || record.Q != [5]float64{10, 20, 30, 40, 50} {
+					errs <- fmt.Errorf("read %+v of %s after count %d", record, connection(r%writers), last)
+					return
+				}
+				last = record.Count
+			}
+		}(r)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stop)
+		readersWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("concurrent reads and writes didn't finish within 30s")
+	}
+
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for w := 0; w < writers; w++ {
+		if record, err := GetPsqrFromConnection(ctx, connection(w), 0.95); err != nil || record.Count != writes {
+			t.Errorf("GetPsqrFromConnection(%s) after the writes = %+v, %v, want count %d", connection(w), record, err, writes)
+		}
+	}
+}
+
+func TestPsqrRecordRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	openTestDatabase(t)
+
+	err := InsertConnectionWithPsqr(ctx, "record", 0.9, 42,
+		1.5, 2.5, 3.5, 4.5, 5.5,
+		1, 10, 21, 32, 42,
+		1, 10.5, 20.5, 31.5, 42,
+		0, 0.45, 0.9, 0.95, 1,
+	)
+	if err != nil {
+		t.Fatalf("InsertConnectionWithPsqr() error = %v", err)
+	}
+
+	want := PsqrRecord{
+		Perc:  0.9,
+		Count: 42,
+		Q:     [5]float64{1.5, 2.5, 3.5, 4.5, 5.5},
+		N:     [5]int{1, 10, 21, 32, 42},
+		Np:    [5]float64{1, 10.5, 20.5, 31.5, 42},
+		Dn:    [5]float64{0, 0.45, 0.9, 0.95, 1},
+	}
+
+	got, err := GetPsqrFromConnection(ctx, "record", 0.9)
+	if err != nil {
+		t.Fatalf("GetPsqrFromConnection() error = %v", err)
+	}
+	want.ID = got.ID
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetPsqrFromConnection() = %+v, want %+v", got, want)
+	}
+
+	if byID, err := GetPsqr(ctx, got.ID); err != nil || !reflect.DeepEqual(byID, want) {
+		t.Errorf("GetPsqr() = %+v, %v, want %+v", byID, err, want)
+	}
+}
+
+func TestPsqrRecordPreviousID(t *testing.T) {
+	ctx := context.Background()
+	openTestDatabase(t)
+	insertTestPsqr(t, "previous", 0.95, 5)
+
+	first, err := GetPsqrFromConnection(ctx, "previous", 0.95)
+	if err != nil {
+		t.Fatalf("GetPsqrFromConnection() error = %v", err)
+	}
+	if first.PreviousID != nil {
+		t.Errorf("PreviousID of the first window = %d, want nil", *first.PreviousID)
+	}
+
+	if _, err := SwapPsqr(ctx, "previous", 0.95); err != nil {
+		t.Fatalf("SwapPsqr() error = %v", err)
+	}
+	second, err := GetPsqrFromConnection(ctx, "previous", 0.95)
+	if err != nil {
+		t.Fatalf("GetPsqrFromConnection() error = %v", err)
+	}
+	if second.PreviousID == nil || *second.PreviousID != first.ID {
+		t.Errorf("PreviousID of the second window = %v, want %d", second.PreviousID, first.ID)
+	}
+}
@@ -2,64 +2,213 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/robobo1221/afostoClassifier/classifier"
 	"github.com/robobo1221/afostoClassifier/database"
 	"go.opentelemetry.io/otel"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
 	"go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"google.golang.org/grpc/credentials"
 
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 )
 
-func sendRequest(ctx context.Context, client *http.Client) {
-	urls := []string{
-		"https://afosto.com",
-		"https://google.com",
-		"https://facebook.com",
-		"https://twitter.com",
-		"https://instagram.com",
-		"https://linkedin.com",
-		"https://youtube.com",
-		"https://reddit.com",
-		"https://tiktok.com",
-		"https://netflix.com",
+// defaultURLs are the targets of the demo load generator.
+var defaultURLs = []string{
+	"https://afosto.com",
+	"https://google.com",
+	"https://facebook.com",
+	"https://twitter.com",
+	"https://instagram.com",
+	"https://linkedin.com",
+	"https://youtube.com",
+	"https://reddit.com",
+	"https://tiktok.com",
+	"https://netflix.com",
+}
+
+// resolveSendConfig returns the targets and interval of the load generator, configurable through
+// SEND_URLS as a comma separated list of absolute http(s) URLs and SEND_INTERVAL as a duration like "500ms".
+func resolveSendConfig() ([]string, time.Duration, error) {
+	urls := defaultURLs
+	if value := os.Getenv("SEND_URLS"); value != "" {
+		urls = nil
+		for _, target := range strings.Split(value, ",") {
+			target = strings.TrimSpace(target)
+			if target == "" {
+				continue
+			}
+
+			u, err := url.Parse(target)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, 0, fmt.Errorf("invalid SEND_URLS entry %q: must be an absolute http(s) URL", target)
+			}
+			urls = append(urls, target)
+		}
+
+		if len(urls) == 0 {
+			return nil, 0, fmt.Errorf("SEND_URLS contains no URLs")
+		}
+	}
+
+	interval := time.Second
+	if value := os.Getenv("SEND_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid SEND_INTERVAL %q: %w", value, err)
+		}
+		if parsed <= 0 {
+			return nil, 0, fmt.Errorf("invalid SEND_INTERVAL %q: must be positive", value)
+		}
+		interval = parsed
+	}
+
+	return urls, interval, nil
+}
+
+// resolveSqliteConfig returns the database file and the pragmas it is opened with, configurable through
+// SQLITE_PATH, SQLITE_JOURNAL_MODE and SQLITE_SYNCHRONOUS, for instance MEMORY and OFF on an ephemeral volume
+// where speed beats durability.
+func resolveSqliteConfig() (database.SqliteConfig, error) {
+	cfg := database.DefaultSqliteConfig()
+	if value := os.Getenv("SQLITE_PATH"); value != "" {
+		cfg.Path = value
+	}
+	if value := os.Getenv("SQLITE_JOURNAL_MODE"); value != "" {
+		cfg.JournalMode = value
+	}
+	if value := os.Getenv("SQLITE_SYNCHRONOUS"); value != "" {
+		cfg.Synchronous = value
 	}
 
+	if err := cfg.Validate(); err != nil {
+		return cfg, fmt.Errorf("invalid SQLITE_PATH, SQLITE_JOURNAL_MODE or SQLITE_SYNCHRONOUS: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// sendRequest requests every url once per interval until ctx is cancelled.
+func sendRequest(ctx context.Context, client *http.Client, urls []string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
 	for {
 		for _, url := range urls {
 			go func(url string) {
 				req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 				resp, err := client.Do(req)
 				if err != nil {
-					fmt.Printf("Error fetching %s: %v\n", url, err)
+					slog.ErrorContext(ctx, "failed to fetch", slog.String("url", url), slog.Any("error", err))
 					return
 				}
 				defer resp.Body.Close()
 			}(url)
 		}
-		time.Sleep(1 * time.Second) // Rate limiting the requests
+
+		// Rate limiting the requests, stopping once the context is cancelled
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
-func setupCollector(ctx context.Context) (*sdktrace.TracerProvider, *metric.MeterProvider, error) {
-	const endpoint = "localhost:4317"
+// sender manages a single load generating worker so repeated starts don't duplicate the load.
+type sender struct {
+	mu       sync.Mutex
+	client   *http.Client
+	urls     []string
+	interval time.Duration
+	cancel   context.CancelFunc // Stops the running worker, nil when no worker is running
+	done     chan struct{}      // Closed once the running worker has exited
+}
 
-	traceExp, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+func newSender(client *http.Client, urls []string, interval time.Duration) *sender {
+	return &sender{
+		client:   client,
+		urls:     urls,
+		interval: interval,
+	}
+}
+
+// start launches the worker unless it is already running. The worker stops when ctx is cancelled or stop is called.
+func (s *sender) start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		return
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+
+	go func(done chan struct{}) {
+		defer close(done)
+		sendRequest(ctx, s.client, s.urls, s.interval)
+	}(s.done)
+}
+
+// stop stops the worker, if running, and waits for it to exit.
+func (s *sender) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel == nil {
+		return
+	}
+
+	s.cancel()
+	<-s.done
+	s.cancel, s.done = nil, nil
+}
+
+func setupCollector(ctx context.Context) (*sdktrace.TracerProvider, *metric.MeterProvider, http.Handler, error) {
+	endpoint, insecure := resolveEndpoint()
+
+	creds, err := exporterCredentials(insecure)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	metricExp, err := otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpoint(endpoint), otlpmetricgrpc.WithInsecure())
+	traceOpts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if creds == nil {
+		traceOpts = append(traceOpts, otlptracegrpc.WithInsecure())
+	} else {
+		traceOpts = append(traceOpts, otlptracegrpc.WithTLSCredentials(creds))
+	}
+
+	traceExp, err := otlptracegrpc.New(ctx, traceOpts...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	metricReader, metricsHandler, err := setupMetricReader(ctx, endpoint, creds)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	tp := sdktrace.NewTracerProvider(
@@ -71,22 +220,215 @@ func setupCollector(ctx context.Context) (*sdktrace.TracerProvider, *metric.Mete
 	)
 
 	mp := metric.NewMeterProvider(
-		metric.WithReader(metric.NewPeriodicReader(metricExp, metric.WithInterval(5*time.Second))),
+		metric.WithReader(metricReader),
 		metric.WithResource(resource.NewWithAttributes(
 			semconv.SchemaURL,
 			semconv.ServiceNameKey.String("testing-service"),
 		)),
 	)
 
-	return tp, mp, nil
+	return tp, mp, metricsHandler, nil
+}
+
+// resolveEndpoint returns the OTLP collector endpoint from OTEL_EXPORTER_OTLP_ENDPOINT, defaulting to localhost:4317,
+// and whether to connect to it without TLS. An http:// or https:// scheme on the endpoint selects insecure or secure
+// respectively, OTEL_EXPORTER_OTLP_INSECURE overrides this when set. Endpoints without a scheme are insecure by default.
+func resolveEndpoint() (string, bool) {
+	const defaultEndpoint = "localhost:4317"
+
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	insecure := true
+
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	} else if u, err := url.Parse(endpoint); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		endpoint = u.Host
+		insecure = u.Scheme == "http"
+	}
+
+	if value := os.Getenv("OTEL_EXPORTER_OTLP_INSECURE"); value != "" {
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			insecure = parsed
+		} else {
+			slog.Warn("ignoring invalid OTEL_EXPORTER_OTLP_INSECURE", slog.String("value", value), slog.Any("error", err))
+		}
+	}
+
+	return endpoint, insecure
+}
+
+// exporterCredentials returns the TLS credentials both OTLP exporters connect with, or nil when insecure.
+// OTEL_EXPORTER_OTLP_CERTIFICATE is the path of a PEM CA certificate to verify the collector with instead of
+// the system roots. OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE and OTEL_EXPORTER_OTLP_CLIENT_KEY are the paths of
+// a PEM client certificate and key for mTLS, they have to be set together.
+func exporterCredentials(insecure bool) (credentials.TransportCredentials, error) {
+	if insecure {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile := os.Getenv("OTEL_EXPORTER_OTLP_CERTIFICATE"); caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read OTEL_EXPORTER_OTLP_CERTIFICATE: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in OTEL_EXPORTER_OTLP_CERTIFICATE %q", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	certFile := os.Getenv("OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE")
+	keyFile := os.Getenv("OTEL_EXPORTER_OTLP_CLIENT_KEY")
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE and OTEL_EXPORTER_OTLP_CLIENT_KEY have to be set together")
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load OTLP client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// setupMetricReader creates the metric reader selected by the METRICS_EXPORTER environment variable.
+// "otlp" (the default) pushes metrics to the collector, "prometheus" exposes them through the returned scrape handler.
+// The collector is connected to with creds, or without TLS when creds is nil.
+func setupMetricReader(ctx context.Context, endpoint string, creds credentials.TransportCredentials) (metric.Reader, http.Handler, error) {
+	switch exporter := os.Getenv("METRICS_EXPORTER"); exporter {
+	case "", "otlp":
+		metricOpts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(endpoint)}
+		if creds == nil {
+			metricOpts = append(metricOpts, otlpmetricgrpc.WithInsecure())
+		} else {
+			metricOpts = append(metricOpts, otlpmetricgrpc.WithTLSCredentials(creds))
+		}
+
+		metricExp, err := otlpmetricgrpc.New(ctx, metricOpts...)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return metric.NewPeriodicReader(metricExp, metric.WithInterval(5*time.Second)), nil, nil
+	case "prometheus":
+		registry := prometheus.NewRegistry()
+
+		promExp, err := otelprometheus.New(otelprometheus.WithRegisterer(registry))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return promExp, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}), nil
+	default:
+		return nil, nil, fmt.Errorf("unknown METRICS_EXPORTER %q, expected \"otlp\" or \"prometheus\"", exporter)
+	}
+}
+
+// resolveHealthThreshold returns the score below which a connection is reported as degraded,
+// configurable through HEALTH_THRESHOLD.
+func resolveHealthThreshold() (float64, error) {
+	threshold := os.Getenv("HEALTH_THRESHOLD")
+	if threshold == "" {
+		return 0.5, nil
+	}
+
+	value, err := strconv.ParseFloat(threshold, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid HEALTH_THRESHOLD %q: %w", threshold, err)
+	}
+
+	return value, nil
+}
+
+// scoresHandler responds with the score, sample count and percentile estimate of every connection of classifiers as JSON.
+func scoresHandler(classifiers *classifier.ResponseClassifiers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(classifiers.Summaries()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// healthHandler responds with 200 when every connection of classifiers scores at or above the threshold and 503 when
+// any connection is degraded. Connections still warming up are considered healthy since their scores
+// aren't meaningful yet. Pass ?verbose=1 to include the per-connection breakdown in the body.
+func healthHandler(classifiers *classifier.ResponseClassifiers, threshold float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		summaries := classifiers.Summaries()
+
+		healthy := true
+		for _, summary := range summaries {
+			if !summary.Warmup && summary.Score < threshold {
+				healthy = false
+				break
+			}
+		}
+
+		body := map[string]any{"healthy": healthy}
+		if verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose")); verbose {
+			body["connections"] = summaries
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(body)
+	}
 }
 
 func main() {
-	ctx := context.Background()
-	tp, mp, err := setupCollector(ctx)
+	// Cancel the context on SIGINT and SIGTERM so everything shuts down gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Log to stderr at the level set by LOG_LEVEL, info by default
+	var level slog.Level
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid LOG_LEVEL %q: %v\n", value, err)
+			os.Exit(1)
+		}
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	if err := run(ctx); err != nil {
+		slog.Error("exiting", slog.Any("error", err))
+		os.Exit(1)
+	}
+}
+
+// run starts the server and blocks until ctx is cancelled, after which the server,
+// tracer provider and meter provider are shut down within shutdownTimeout.
+func run(ctx context.Context) error {
+	const shutdownTimeout = 10 * time.Second
+
+	healthThreshold, err := resolveHealthThreshold()
 	if err != nil {
-		fmt.Println("Error setting up collector:", err)
-		return
+		return err
+	}
+
+	sendURLs, sendInterval, err := resolveSendConfig()
+	if err != nil {
+		return err
+	}
+
+	sqliteConfig, err := resolveSqliteConfig()
+	if err != nil {
+		return err
+	}
+
+	tp, mp, metricsHandler, err := setupCollector(ctx)
+	if err != nil {
+		return fmt.Errorf("error setting up collector: %w", err)
 	}
 
 	// Set the global TracerProvider and MeterProvider
@@ -94,28 +436,95 @@ func main() {
 	otel.SetMeterProvider(mp)
 
 	// Initialize database
+	database.SetLogger(slog.Default())
+	if err := database.SetSqliteConfig(sqliteConfig); err != nil {
+		return fmt.Errorf("error configuring database: %w", err)
+	}
 	database.InitSqlite()
 	database.Migrate()
 
+	classifier.ResponseClassifiersInstance.SetLogger(slog.Default())
+
+	// Keep a day of scores, one per connection every 10 seconds
+	classifier.ResponseClassifiersInstance.SetScoreHistoryInterval(10 * time.Second)
+	if err := classifier.ResponseClassifiersInstance.StartScoreHistoryPruner(ctx, 24*time.Hour, time.Hour); err != nil {
+		return err
+	}
+
+	// Persist the windows of debounced classifiers that stopped receiving responses
+	if err := classifier.ResponseClassifiersInstance.StartFlusher(ctx, time.Second); err != nil {
+		return err
+	}
+
+	// Restore the classifiers of connections seen before a restart
+	if err := classifier.ResponseClassifiersInstance.WarmFromStore(); err != nil {
+		return err
+	}
+
 	// Create a new client with the custom RoundTripper
 	client := &http.Client{
 		Transport: classifier.NewClassifierRoundTripper(classifier.ResponseClassifiersInstance),
 	}
 
-	http.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
-		go sendRequest(ctx, client)
+	mux := http.NewServeMux()
+	// Only a single worker generates load, /send?action=stop stops it again
+	loadSender := newSender(client, sendURLs, sendInterval)
+	defer loadSender.stop()
+
+	mux.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
+		switch action := r.URL.Query().Get("action"); action {
+		case "", "start":
+			loadSender.start(ctx)
+		case "stop":
+			loadSender.stop()
+		default:
+			http.Error(w, fmt.Sprintf("unknown action %q", action), http.StatusBadRequest)
+		}
 	})
 
+	mux.HandleFunc("/scores", scoresHandler(classifier.ResponseClassifiersInstance))
+
+	mux.HandleFunc("/healthz", healthHandler(classifier.ResponseClassifiersInstance, healthThreshold))
+
+	// Expose a scrape endpoint when metrics are exported to Prometheus
+	if metricsHandler != nil {
+		mux.Handle("/metrics", metricsHandler)
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	fmt.Printf("Server is running on port %s\n", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		fmt.Println("Error starting server:", err)
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: mux,
 	}
 
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("server is running", slog.String("port", port))
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err = <-serveErr:
+		err = fmt.Errorf("error starting server: %w", err)
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	}
+
+	// Use a fresh context since ctx is already cancelled at this point
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	return errors.Join(
+		err,
+		srv.Shutdown(shutdownCtx),
+		classifier.ResponseClassifiersInstance.Flush(shutdownCtx),
+		tp.Shutdown(shutdownCtx),
+		mp.Shutdown(shutdownCtx),
+	)
 }
 
 /*
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/robobo1221/afostoClassifier/classifier"
+	"github.com/robobo1221/afostoClassifier/database"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/metric"
+)
+
+// testDatabaseConfig configures the fresh database TestMain runs the tests against.
+var testDatabaseConfig database.SqliteConfig
+
+// TestMain runs the tests against a fresh database in a temporary directory.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "afostoClassifier")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	testDatabaseConfig = database.DefaultSqliteConfig()
+	testDatabaseConfig.Path = filepath.Join(dir, "classifierData.db")
+	if err := database.SetSqliteConfig(testDatabaseConfig); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	database.Migrate()
+
+	code := m.Run()
+
+	database.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestPrometheusMetricsExposeResponseTime(t *testing.T) {
+	t.Setenv("METRICS_EXPORTER", "prometheus")
+
+	reader, handler, err := setupMetricReader(context.Background(), "localhost:4317", nil)
+	if err != nil {
+		t.Fatalf("setupMetricReader() error = %v", err)
+	}
+	if handler == nil {
+		t.Fatal("setupMetricReader() returned no scrape handler for the prometheus exporter")
+	}
+
+	mp := metric.NewMeterProvider(metric.WithReader(reader))
+	previous := otel.GetMeterProvider()
+	otel.SetMeterProvider(mp)
+	t.Cleanup(func() {
+		otel.SetMeterProvider(previous)
+		mp.Shutdown(context.Background())
+	})
+
+	rcs := classifier.NewResponseClassifiers()
+	rcs.SetObserveOnly(true)
+	if _, err := rcs.DispatchWithConfig(context.Background(), t.Name(), classifier.DefaultClassifierConfig(), 20*time.Millisecond, 200, -1); err != nil {
+		t.Fatalf("DispatchWithConfig() error = %v", err)
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read /metrics: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "http_response_time") {
+		t.Errorf("GET /metrics = %d, want 200 with http_response_time in\n%s", resp.StatusCode, body)
+	}
+}
+
+func TestResolveEndpoint(t *testing.T) {
+	tests := []struct {
+		name         string
+		endpoint     string
+		insecureEnv  string
+		wantEndpoint string
+		wantInsecure bool
+	}{
+		{name: "unset", wantEndpoint: "localhost:4317", wantInsecure: true},
+		{name: "without scheme", endpoint: "collector:4317", wantEndpoint: "collector:4317", wantInsecure: true},
+		{name: "http", endpoint: "http://collector:4317", wantEndpoint: "collector:4317", wantInsecure: true},
+		{name: "https", endpoint: "https://collector:4317", wantEndpoint: "collector:4317", wantInsecure: false},
+		{name: "insecure override", endpoint: "https://collector:4317", insecureEnv: "true", wantEndpoint: "collector:4317", wantInsecure: true},
+		{name: "secure override", endpoint: "collector:4317", insecureEnv: "false", wantEndpoint: "collector:4317", wantInsecure: false},
+		{name: "invalid override", endpoint: "https://collector:4317", insecureEnv: "maybe", wantEndpoint: "collector:4317", wantInsecure: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", tt.endpoint)
+			t.Setenv("OTEL_EXPORTER_OTLP_INSECURE", tt.insecureEnv)
+
+			endpoint, insecure := resolveEndpoint()
+			if endpoint != tt.wantEndpoint || insecure != tt.wantInsecure {
+				t.Errorf("resolveEndpoint() = %q, %v, want %q, %v", endpoint, insecure, tt.wantEndpoint, tt.wantInsecure)
+			}
+		})
+	}
+}
+
+func TestRunShutsDownWhenContextIsCancelled(t *testing.T) {
+	// run configures and opens the database itself
+	if err := database.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	t.Cleanup(func() {
+		if err := database.Close(); err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+		if err := database.SetSqliteConfig(testDatabaseConfig); err != nil {
+			t.Errorf("SetSqliteConfig() error = %v", err)
+		}
+	})
+
+	t.Setenv("SQLITE_PATH", filepath.Join(t.TempDir(), "classifierData.db"))
+	t.Setenv("METRICS_EXPORTER", "prometheus")
+	t.Setenv("PORT", "0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx)
+	}()
+
+	// Give run the time to start serving before shutting it down
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run() error = %v", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("run() didn't return after its context was cancelled")
+	}
+}
+
+func TestScoresHandler(t *testing.T) {
+	rcs := classifier.NewResponseClassifiers()
+	rcs.SetObserveOnly(true)
+	for _, connection := range []string{"a.test", "b.test"} {
+		for i := 0; i < 6; i++ {
+			if _, err := rcs.DispatchWithConfig(context.Background(), connection, classifier.DefaultClassifierConfig(), time.Duration(10+i)*time.Millisecond, 200, -1); err != nil {
+				t.Fatalf("DispatchWithConfig() error = %v", err)
+			}
+		}
+	}
+
+	server := httptest.NewServer(scoresHandler(rcs))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	if got := resp.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+
+	var scores map[string]classifier.ScoreSummary
+	if err := json.NewDecoder(resp.Body).Decode(&scores); err != nil {
+		t.Fatalf("failed to decode the scores: %v", err)
+	}
+
+	if len(scores) != 2 {
+		t.Errorf("scores of %d connections, want a.test and b.test", len(scores))
+	}
+	for _, connection := range []string{"a.test", "b.test"} {
+		summary, ok := scores[connection]
+		if !ok {
+			t.Errorf("no score for %s", connection)
+			continue
+		}
+		if summary.Score < 0 || summary.Score > 1 || summary.Count != 6 || summary.P95 <= 0 {
+			t.Errorf("score of %s = %+v, want a score between 0 and 1 over 6 samples with a percentile estimate", connection, summary)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	rcs := classifier.NewResponseClassifiers()
+
+	// dispatch classifies n responses of a connection, each scored as given
+	dispatch := func(connection string, score float64, n int) {
+		t.Helper()
+
+		cfg := classifier.DefaultClassifierConfig()
+		cfg.Options = []classifier.ResponseClassifierOption{
+			classifier.WithScoreFunc(func(time.Duration, time.Duration, int) float64 { return score }),
+		}
+		for i := 0; i < n; i++ {
+			if _, err := rcs.DispatchWithConfig(context.Background(), connection, cfg, 10*time.Millisecond, 200, -1); err != nil {
+				t.Fatalf("DispatchWithConfig() error = %v", err)
+			}
+		}
+	}
+
+	server := httptest.NewServer(healthHandler(rcs, 0.5))
+	defer server.Close()
+
+	check := func(want int, wantConnections int) {
+		t.Helper()
+
+		resp, err := http.Get(server.URL + "?verbose=1")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		defer resp.Body.Close()
+
+		var body struct {
+			Healthy     bool                               `json:"healthy"`
+			Connections map[string]classifier.ScoreSummary `json:"connections"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("failed to decode the health: %v", err)
+		}
+
+		if resp.StatusCode != want || body.Healthy != (want == http.StatusOK) {
+			t.Errorf("health = %d with healthy %v, want %d", resp.StatusCode, body.Healthy, want)
+		}
+		if len(body.Connections) != wantConnections {
+			t.Errorf("health lists %d connections, want %d", len(body.Connections), wantConnections)
+		}
+	}
+
+	// Without connections there is nothing degraded
+	check(http.StatusOK, 0)
+
+	dispatch(t.Name()+"/healthy-a", 1, 20)
+	dispatch(t.Name()+"/healthy-b", 1, 20)
+	check(http.StatusOK, 2)
+
+	// A low score while warming up isn't meaningful yet
+	dispatch(t.Name()+"/degraded", 0, 4)
+	check(http.StatusOK, 3)
+
+	dispatch(t.Name()+"/degraded", 0, 16)
+	check(http.StatusServiceUnavailable, 3)
+}
+
+func TestSenderWorkerExitsOnCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	s := newSender(server.Client(), []string{server.URL}, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.start(ctx)
+
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+
+	// Starting again keeps the running worker
+	s.start(ctx)
+	s.mu.Lock()
+	restarted := s.done != done
+	s.mu.Unlock()
+	if restarted {
+		t.Error("start() while running started a second worker")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker didn't exit after its context was cancelled")
+	}
+
+	// stop cleans up after the exited worker, so a new one can be started and stopped
+	s.stop()
+	s.start(context.Background())
+	s.stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil || s.done != nil {
+		t.Error("stop() left the worker registered")
+	}
+}
+
+func TestSendRequestHitsEveryURLThroughClassifier(t *testing.T) {
+	var hits [2]atomic.Int64
+	urls := make([]string, len(hits))
+	for i := range hits {
+		hit := &hits[i]
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hit.Add(1)
+		}))
+		defer server.Close()
+		urls[i] = server.URL
+	}
+
+	rcs := classifier.NewResponseClassifiers()
+	rcs.SetObserveOnly(true)
+	client := &http.Client{Transport: classifier.NewClassifierRoundTripper(rcs)}
+
+	s := newSender(client, urls, 10*time.Millisecond)
+	s.start(context.Background())
+	defer s.stop()
+
+	// Both servers are hit and their responses classified, each under its own connection
+	deadline := time.Now().Add(5 * time.Second)
+	for hits[0].Load() == 0 || hits[1].Load() == 0 || len(rcs.Snapshot()) < len(urls) {
+		if time.Now().After(deadline) {
+			t.Fatalf("after 5s: hits %d and %d, %d classified connections, want both hit and classified",
+				hits[0].Load(), hits[1].Load(), len(rcs.Snapshot()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResolveSendConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		urls         string
+		interval     string
+		wantURLs     []string
+		wantInterval time.Duration
+		wantErr      bool
+	}{
+		{name: "defaults", wantURLs: defaultURLs, wantInterval: time.Second},
+		{name: "configured", urls: "http://a.test, https://b.test/path,", interval: "250ms", wantURLs: []string{"http://a.test", "https://b.test/path"}, wantInterval: 250 * time.Millisecond},
+		{name: "relative URL", urls: "a.test", wantErr: true},
+		{name: "unsupported scheme", urls: "ftp://a.test", wantErr: true},
+		{name: "no URLs", urls: " , ", wantErr: true},
+		{name: "zero interval", interval: "0s", wantErr: true},
+		{name: "negative interval", interval: "-1s", wantErr: true},
+		{name: "invalid interval", interval: "soon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SEND_URLS", tt.urls)
+			t.Setenv("SEND_INTERVAL", tt.interval)
+
+			urls, interval, err := resolveSendConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("resolveSendConfig() = %v, %s, want an error", urls, interval)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveSendConfig() error = %v", err)
+			}
+			if !slices.Equal(urls, tt.wantURLs) || interval != tt.wantInterval {
+				t.Errorf("resolveSendConfig() = %v, %s, want %v, %s", urls, interval, tt.wantURLs, tt.wantInterval)
+			}
+		})
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and its key to dir as PEM files, usable
+// both as a server or client certificate and as the CA verifying it.
+func writeTestCertificate(t *testing.T, dir string, name string) (certFile string, keyFile string, cert tls.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("failed to load key pair: %v", err)
+	}
+
+	return certFile, keyFile, cert
+}
+
+// handshake connects to a TLS listener configured with serverConfig using the exporter credentials, and
+// returns the number of certificates the client presented and the error of the client handshake.
+func handshake(t *testing.T, serverConfig *tls.Config) (int, error) {
+	t.Helper()
+
+	creds, err := exporterCredentials(false)
+	if err != nil {
+		t.Fatalf("exporterCredentials() error = %v", err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	peers := make(chan int, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			peers <- -1
+			return
+		}
+		defer conn.Close()
+
+		tlsConn := conn.(*tls.Conn)
+		tlsConn.Handshake()
+		peers <- len(tlsConn.ConnectionState().PeerCertificates)
+	}()
+
+	rawConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer rawConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := creds.ClientHandshake(ctx, listener.Addr().String(), rawConn)
+	if err == nil {
+		// Reading lets the server verify the client certificate, which TLS 1.3 does after the client handshake
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+
+	return <-peers, err
+}
+
+func TestExporterCredentials(t *testing.T) {
+	dir := t.TempDir()
+	serverCertFile, _, serverCert := writeTestCertificate(t, dir, "server")
+	clientCertFile, clientKeyFile, _ := writeTestCertificate(t, dir, "client")
+
+	t.Run("insecure", func(t *testing.T) {
+		// Credentials aren't even read when insecure
+		t.Setenv("OTEL_EXPORTER_OTLP_CERTIFICATE", filepath.Join(dir, "missing.crt"))
+
+		creds, err := exporterCredentials(true)
+		if creds != nil || err != nil {
+			t.Errorf("exporterCredentials(true) = %v, %v, want no credentials", creds, err)
+		}
+	})
+
+	t.Run("TLS with CA", func(t *testing.T) {
+		serverConfig := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+
+		// The self-signed server certificate isn't trusted by the system roots
+		t.Setenv("OTEL_EXPORTER_OTLP_CERTIFICATE", "")
+		if _, err := handshake(t, serverConfig); err == nil {
+			t.Error("handshake without the CA succeeded, want the server certificate rejected")
+		}
+
+		t.Setenv("OTEL_EXPORTER_OTLP_CERTIFICATE", serverCertFile)
+		if peers, err := handshake(t, serverConfig); err != nil || peers != 0 {
+			t.Errorf("handshake with the CA = %v with %d client certificates, want success without one", err, peers)
+		}
+	})
+
+	t.Run("mTLS", func(t *testing.T) {
+		clientCAs := x509.NewCertPool()
+		clientPEM, err := os.ReadFile(clientCertFile)
+		if err != nil {
+			t.Fatalf("failed to read client certificate: %v", err)
+		}
+		clientCAs.AppendCertsFromPEM(clientPEM)
+
+		serverConfig := &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+		}
+
+		t.Setenv("OTEL_EXPORTER_OTLP_CERTIFICATE", serverCertFile)
+		t.Setenv("OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE", clientCertFile)
+		t.Setenv("OTEL_EXPORTER_OTLP_CLIENT_KEY", clientKeyFile)
+		if peers, err := handshake(t, serverConfig); err != nil || peers != 1 {
+			t.Errorf("handshake with a client certificate = %v with %d client certificates, want success with one", err, peers)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		notPEM := filepath.Join(dir, "empty.crt")
+		if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+
+		tests := []struct {
+			name, ca, cert, key string
+		}{
+			{name: "missing CA", ca: filepath.Join(dir, "missing.crt")},
+			{name: "CA without certificates", ca: notPEM},
+			{name: "certificate without key", cert: clientCertFile},
+			{name: "key without certificate", key: clientKeyFile},
+			{name: "mismatched key", cert: serverCertFile, key: clientKeyFile},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				t.Setenv("OTEL_EXPORTER_OTLP_CERTIFICATE", tt.ca)
+				t.Setenv("OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE", tt.cert)
+				t.Setenv("OTEL_EXPORTER_OTLP_CLIENT_KEY", tt.key)
+
+				if _, err := exporterCredentials(false); err == nil {
+					t.Error("exporterCredentials(false) succeeded, want an error")
+				}
+			})
+		}
+	})
+}
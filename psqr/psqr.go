@@ -1,11 +1,24 @@
 package psqr
 
-import "sync"
+import (
+	"fmt"
+	"math"
+)
 
-// Psqr collects observations and returns an estimate of requested p-quantile, as described in the P-Square algorithm
+// Psqr collects observations and returns an estimate of requested p-quantile, as described in the P-Square algorithm.
+// None of its methods lock, a Psqr shared between goroutines must be guarded by the caller, like the classifier
+// does with its own mutex. The accessors return copies, so their results can be used after unlocking.
 type Psqr struct {
-	sync.Mutex
+	perc  float64
+	count int
+	q     [5]float64 // Marker heights
+	n     [5]int     // Marker positions
+	np    [5]float64 // Desired marker positions
+	dn    [5]float64 // Increments of the desired marker positions
+}
 
+// State is a copy of the internal state of a Psqr, used to persist an estimator and restore it later.
+type State struct {
 	Perc  float64
 	Count int
 	Q     [5]float64
@@ -17,13 +30,60 @@ type Psqr struct {
 // NewPsqr returns a new instance of Psqr
 func NewPsqr(q float64) *Psqr {
 	p := &Psqr{}
-	p.Perc = q
+	p.perc = q
 	p.Reset()
 	return p
 }
 
+// Restore replaces the state of the estimator with a previously saved one, for instance loaded from the database.
+func (p *Psqr) Restore(state State) {
+	p.perc = state.Perc
+	p.count = state.Count
+	p.q = state.Q
+	p.n = state.N
+	p.np = state.Np
+	p.dn = state.Dn
+}
+
+// State returns a copy of the state of the estimator, which Restore accepts to continue from it.
+func (p *Psqr) State() State {
+	return State{
+		Perc:  p.perc,
+		Count: p.count,
+		Q:     p.q,
+		N:     p.n,
+		Np:    p.np,
+		Dn:    p.dn,
+	}
+}
+
+// Perc returns the p-quantile the estimator estimates.
+func (p *Psqr) Perc() float64 {
+	return p.perc
+}
+
+// Count returns the number of observations collected, counting a weighted observation as its weight.
+func (p *Psqr) Count() int {
+	return p.count
+}
+
 // Add collects a new observation, updates marker positions and the current estimate
 func (p *Psqr) Add(v float64) float64 {
+	return p.AddWeighted(v, 1)
+}
+
+// AddWeighted collects an observation that counts as weight observations, for instance when only one in
+// weight requests is sampled. Count and the marker positions advance by weight and every marker may move
+// up to weight times, approximating weight consecutive calls to Add with the same value.
+// The first five observations are stored as is, so a weighted observation collected while fewer than five
+// observations are known fills the remaining slots with copies of v before the rest of its weight is applied.
+// A weight of 0 or less is ignored, and so are NaN and infinite observations, which would otherwise poison
+// the markers for good.
+func (p *Psqr) AddWeighted(v float64, weight int) float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return p.q[2]
+	}
+
 	sign := func(f float64) int {
 		if f < 0.0 {
 			return -1
@@ -32,98 +92,264 @@ func (p *Psqr) Add(v float64) float64 {
 	}
 
 	parabolic := func(i, d int) float64 {
-		qi, qip1, qim1 := p.Q[i], p.Q[i+1], p.Q[i-1]
-		ni, nip1, nim1 := float64(p.N[i]), float64(p.N[i+1]), float64(p.N[i-1])
+		qi, qip1, qim1 := p.q[i], p.q[i+1], p.q[i-1]
+		ni, nip1, nim1 := float64(p.n[i]), float64(p.n[i+1]), float64(p.n[i-1])
 		df := float64(d)
 		return qi + df/(nip1-nim1)*((ni-nim1+df)*(qip1-qi)/(nip1-ni)+(nip1-ni-df)*(qi-qim1)/(ni-nim1))
 	}
 
 	linear := func(i, d int) float64 {
+		// markers are only moved towards a neighbour more than one position away, but a state restored from
+		// elsewhere is not guaranteed to hold on to that
+		dn := p.n[i+d] - p.n[i]
+		if dn == 0 {
+			return p.q[i]
+		}
 		df := float64(d)
-		return p.Q[i] + df*(p.Q[i+d]-p.Q[i])/float64(p.N[i+d]-p.N[i])
+		if diff := p.q[i+d] - p.q[i]; !math.IsInf(diff, 0) {
+			return p.q[i] + df*diff/float64(dn)
+		}
+		// the difference of heights of opposite signs close to the largest float overflows, weigh both
+		// heights instead
+		t := df / float64(dn)
+		return p.q[i]*(1-t) + p.q[i+d]*t
 	}
 
-	if p.Count < 5 {
+	for ; weight > 0 && p.count < 5; weight-- {
 		// store the first observations
-		p.Q[p.Count], p.Count = v, p.Count+1
+		p.q[p.count], p.count = v, p.count+1
 
-		if p.Count == 5 {
+		if p.count == 5 {
 			// sort the first observations
-			for i := 1; i < p.Count; i++ {
-				for j := i; j > 0 && p.Q[j-1] > p.Q[j]; j-- {
-					p.Q[j], p.Q[j-1] = p.Q[j-1], p.Q[j]
+			for i := 1; i < p.count; i++ {
+				for j := i; j > 0 && p.q[j-1] > p.q[j]; j-- {
+					p.q[j], p.q[j-1] = p.q[j-1], p.q[j]
 				}
 			}
 		}
+	}
 
-		// note that p.Q[2] is meaningless at this point
-		return p.Q[2]
+	if weight <= 0 {
+		// note that p.q[2] is meaningless while fewer than five observations are known
+		return p.q[2]
 	}
 
-	p.Count = p.Count + 1
+	p.count = p.count + weight
 
-	// find cell k such that [qk < xj < qk+1] and adjust extreme values if necessary
+	// find cell k such that [qk < xj < qk+1] and adjust extreme values if necessary.
+	// Observations outside the extremes are handled first, they are common for sorted input and
+	// leave only the three interior markers to compare against, which is done without branching.
 	var k int
-	for k = 0; k < 5; k++ {
-		if v < p.Q[k] {
-			break
-		}
-	}
-
-	if k == 0 {
+	if v < p.q[0] {
 		k = 1
-		p.Q[0] = v
-	} else if k == 5 {
+		p.q[0] = v
+	} else if v >= p.q[4] {
 		k = 4
-		p.Q[4] = v
+		p.q[4] = v
+	} else {
+		k = 1 + b2i(v >= p.q[1]) + b2i(v >= p.q[2]) + b2i(v >= p.q[3])
 	}
 
-	// increment positions of markers k+1 through 5
-	for i := k; i < 5; i++ {
-		p.N[i]++
+	// increment positions of markers k+1 through 5, unrolled since k is known to be between 1 and 4
+	switch k {
+	case 1:
+		p.n[1] += weight
+		fallthrough
+	case 2:
+		p.n[2] += weight
+		fallthrough
+	case 3:
+		p.n[3] += weight
+		fallthrough
+	default:
+		p.n[4] += weight
 	}
 
 	// update desired positions for all markers
-	for i := 0; i < 5; i++ {
-		p.Np[i] = p.Np[i] + p.Dn[i]
-	}
+	w := float64(weight)
+	p.np[0], p.np[1], p.np[2], p.np[3], p.np[4] = p.np[0]+p.dn[0]*w, p.np[1]+p.dn[1]*w, p.np[2]+p.dn[2]*w, p.np[3]+p.dn[3]*w, p.np[4]+p.dn[4]*w
 
-	// adjust heights of markers 2-4 if necessary
+	// adjust heights of markers 2-4 if necessary, once per observation the weight stands for
 	for i := 1; i < 4; i++ {
-		d := p.Np[i] - float64(p.N[i])
-		if (d >= 1.0 && p.N[i+1]-p.N[i] > 1) || (d <= -1.0 && p.N[i-1]-p.N[i] < -1) {
+		for step := 0; step < weight; step++ {
+			d := p.np[i] - float64(p.n[i])
+			if !((d >= 1.0 && p.n[i+1]-p.n[i] > 1) || (d <= -1.0 && p.n[i-1]-p.n[i] < -1)) {
+				break
+			}
+
 			ds := sign(d)
 			qp := parabolic(i, ds)
 
-			if p.Q[i-1] < qp && qp < p.Q[i+1] {
-				p.Q[i] = qp
+			if p.q[i-1] < qp && qp < p.q[i+1] {
+				p.q[i] = qp
 			} else {
-				p.Q[i] = linear(i, ds)
+				p.q[i] = linear(i, ds)
 			}
-			p.N[i] = p.N[i] + ds
+			p.n[i] = p.n[i] + ds
 		}
 	}
 
 	// return the current estimate of p-quantile
-	return p.Q[2]
+	return p.q[2]
+}
+
+// b2i converts a comparison to 0 or 1, which the compiler turns into a branchless set instruction
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 // Get returns the current estimate of p-quantile
 func (p *Psqr) Get() float64 {
-	return p.Q[2]
+	return p.q[2]
+}
+
+// Stability returns how far the markers are from their desired positions, normalized by the number of observations,
+// as a rough indicator of how settled the estimate is. It is 0 for a converged estimate, higher values mean it is
+// still settling and 1 is returned while fewer than five observations have been collected. Markers only move in whole
+// positions, so a gap of one position is always counted and the value only approaches 0 as observations accumulate.
+func (p *Psqr) Stability() float64 {
+	if p.count < 5 {
+		return 1.0
+	}
+
+	// only the interior markers move, the extreme ones are always at their desired positions
+	gap := 1.0
+	for i := 1; i < 4; i++ {
+		gap += math.Abs(p.np[i] - float64(p.n[i]))
+	}
+
+	return math.Min(gap/float64(p.count-4), 1.0)
+}
+
+// Markers returns copies of the marker heights and their positions, for instance to plot the estimated distribution.
+// The heights are sorted, the positions are the number of observations at or below each marker.
+func (p *Psqr) Markers() ([5]float64, [5]int) {
+	return p.q, p.n
+}
+
+// Quantile returns a rough estimate of an arbitrary quantile by linearly interpolating between the markers.
+// The five markers track the minimum, p/2, p, (1+p)/2 and the maximum, so the estimate is only as good as Get
+// close to Perc and degrades the further target is from Perc, in particular in the tails where nothing but the
+// extreme observations is known. Use a separate Psqr when a quantile far from Perc has to be accurate.
+// Quantile returns Get when target equals Perc or fewer than five observations have been collected.
+func (p *Psqr) Quantile(target float64) float64 {
+	if target == p.perc || p.count < 5 {
+		return p.Get()
+	}
+
+	target = math.Min(math.Max(target, 0.0), 1.0)
+
+	// find the markers surrounding the target, using their actual positions expressed as quantiles
+	last := float64(p.count - 1)
+	for i := 1; i < 5; i++ {
+		lo := float64(p.n[i-1]-1) / last
+		hi := float64(p.n[i]-1) / last
+
+		if target <= hi || i == 4 {
+			if hi <= lo {
+				return p.q[i]
+			}
+			return p.q[i-1] + (target-lo)/(hi-lo)*(p.q[i]-p.q[i-1])
+		}
+	}
+
+	return p.Get()
+}
+
+// equalTolerance is the absolute difference up to which float fields are considered equal,
+// so estimates surviving a round trip through the database or a different order of operations compare equal.
+const equalTolerance = 1e-9
+
+// Equal reports whether both estimators have the same state, comparing float fields within a small tolerance.
+func (p *Psqr) Equal(other *Psqr) bool {
+	return p.Diff(other) == ""
+}
+
+// Diff describes the first field in which both estimators differ, or returns an empty string when they are equal.
+func (p *Psqr) Diff(other *Psqr) string {
+	if p == nil || other == nil {
+		if p == other {
+			return ""
+		}
+		return fmt.Sprintf("nil mismatch: %v != %v", p == nil, other == nil)
+	}
+
+	floatEqual := func(a, b float64) bool {
+		return math.Abs(a-b) <= equalTolerance
+	}
+
+	if !floatEqual(p.perc, other.perc) {
+		return fmt.Sprintf("Perc: %v != %v", p.perc, other.perc)
+	}
+	if p.count != other.count {
+		return fmt.Sprintf("Count: %d != %d", p.count, other.count)
+	}
+	for i := 0; i < 5; i++ {
+		if !floatEqual(p.q[i], other.q[i]) {
+			return fmt.Sprintf("Q[%d]: %v != %v", i, p.q[i], other.q[i])
+		}
+		if p.n[i] != other.n[i] {
+			return fmt.Sprintf("N[%d]: %d != %d", i, p.n[i], other.n[i])
+		}
+		if !floatEqual(p.np[i], other.np[i]) {
+			return fmt.Sprintf("Np[%d]: %v != %v", i, p.np[i], other.np[i])
+		}
+		if !floatEqual(p.dn[i], other.dn[i]) {
+			return fmt.Sprintf("Dn[%d]: %v != %v", i, p.dn[i], other.dn[i])
+		}
+	}
+
+	return ""
 }
 
 func (p *Psqr) Reset() {
-	q := p.Perc
+	q := p.perc
 
-	p.Count = 0
+	p.count = 0
 
 	// calculate and store the increment in desired marker positions
-	p.Dn[0], p.Dn[1], p.Dn[2], p.Dn[3], p.Dn[4] = 0.0, q*0.5, q, (1+q)*0.5, 1.0
+	p.dn[0], p.dn[1], p.dn[2], p.dn[3], p.dn[4] = 0.0, q*0.5, q, (1+q)*0.5, 1.0
 
 	// set initial marker positions
 	for i := 0; i < 5; i++ {
-		p.N[i] = i + 1
-		p.Np[i] = p.Dn[i]*4 + 1
+		p.n[i] = i + 1
+		p.np[i] = p.dn[i]*4 + 1
+	}
+}
+
+// ResetSeeded starts over like Reset, but seeds the estimator with the current marker heights as if it had
+// collected weight observations distributed like the current ones, so a new window starts from the previous
+// estimate and its spread instead of from nothing. On a stationary stream it converges faster the heavier the
+// seed, while a heavy seed takes longer to give way after a change. The seed counts as weight observations,
+// at least five and at most as many as have been collected. It falls back to Reset while fewer than five
+// observations have been collected, the markers mean nothing yet.
+func (p *Psqr) ResetSeeded(weight int) {
+	if p.count < 5 {
+		p.Reset()
+		return
+	}
+
+	seed := p.q
+	weight = min(max(weight, 5), p.count)
+	p.Reset()
+
+	p.q = seed
+	p.count = weight
+
+	// place the markers where they would be after weight observations, keeping the positions strictly increasing
+	// and within 1 and weight when rounding puts neighbours on the same position
+	last := float64(weight - 1)
+	for i := 0; i < 5; i++ {
+		p.np[i] = 1 + last*p.dn[i]
+		p.n[i] = int(math.Round(p.np[i]))
+	}
+	for i := 3; i >= 0; i-- {
+		p.n[i] = min(p.n[i], p.n[i+1]-1)
+	}
+	for i := 1; i < 5; i++ {
+		p.n[i] = max(p.n[i], p.n[i-1]+1)
 	}
 }
@@ -0,0 +1,382 @@
+package psqr
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRestoreContinuesFromState(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	p := NewPsqr(0.95)
+	for i := 0; i < 100; i++ {
+		p.Add(r.Float64())
+	}
+
+	restored := NewPsqr(0.5)
+	restored.Restore(p.State())
+	if diff := restored.Diff(p); diff != "" {
+		t.Fatalf("restored estimator differs: %s", diff)
+	}
+
+	for i := 0; i < 100; i++ {
+		v := r.Float64()
+		p.Add(v)
+		restored.Add(v)
+	}
+	if diff := restored.Diff(p); diff != "" {
+		t.Errorf("restored estimator differs after more observations: %s", diff)
+	}
+
+	// The markers are copies, changing them leaves the estimator alone
+	q, n := p.Markers()
+	q[2], n[2] = -1, -1
+	if got, _ := p.Markers(); got[2] == -1 || p.Get() == -1 {
+		t.Error("changing the returned markers changed the estimator")
+	}
+}
+
+func TestEqualAndDiff(t *testing.T) {
+	build := func(values ...float64) *Psqr {
+		p := NewPsqr(0.5)
+		for _, v := range values {
+			p.Add(v)
+		}
+		return p
+	}
+	values := []float64{5, 1, 4, 2, 3, 8, 6, 7}
+
+	// Equal
+	a, b := build(values...), build(values...)
+	if !a.Equal(b) || a.Diff(b) != "" {
+		t.Errorf("identical estimators differ: %s", a.Diff(b))
+	}
+
+	// Within the float tolerance
+	b.q[2] += equalTolerance / 2
+	if !a.Equal(b) {
+		t.Errorf("estimators within tolerance differ: %s", a.Diff(b))
+	}
+
+	// Marker differing
+	b.q[2] += 1
+	if a.Equal(b) {
+		t.Error("estimators with differing markers are equal")
+	}
+	if diff := a.Diff(b); !strings.HasPrefix(diff, "Q[2]: ") {
+		t.Errorf("Diff() = %q, want it to name Q[2]", diff)
+	}
+
+	// Count differing
+	c := build(append(values, 9)...)
+	if a.Equal(c) {
+		t.Error("estimators with differing counts are equal")
+	}
+	if diff, want := a.Diff(c), "Count: 8 != 9"; diff != want {
+		t.Errorf("Diff() = %q, want %q", diff, want)
+	}
+
+	// Nil
+	var nilPsqr *Psqr
+	if !nilPsqr.Equal(nil) {
+		t.Error("two nil estimators differ")
+	}
+	if a.Equal(nil) || nilPsqr.Equal(a) {
+		t.Error("a nil and a non-nil estimator are equal")
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	const n = 10000
+
+	// quantiles collects n observations drawn by next at Perc 0.95 and returns the estimator with the sorted observations
+	quantiles := func(next func() float64) (*Psqr, []float64) {
+		p := NewPsqr(0.95)
+		values := make([]float64, n)
+		for i := range values {
+			values[i] = next()
+			p.Add(values[i])
+		}
+		sort.Float64s(values)
+		return p, values
+	}
+	exact := func(values []float64, target float64) float64 {
+		return values[min(int(target*float64(len(values))), len(values)-1)]
+	}
+
+	r := rand.New(rand.NewSource(1))
+
+	// Uniform observations are close to linear between the markers, so every target is read accurately
+	p, values := quantiles(func() float64 { return r.Float64() * 1000 })
+	for _, target := range []float64{0, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 1} {
+		if got, want := p.Quantile(target), exact(values, target); math.Abs(got-want) > 30 {
+			t.Errorf("uniform Quantile(%v) = %v, want within 30 of %v", target, got, want)
+		}
+	}
+
+	// Exponential observations are not, only targets at or close to the markers are read accurately
+	p, values = quantiles(func() float64 { return r.ExpFloat64() * 100 })
+	for _, tt := range []struct {
+		target, relErr float64
+	}{
+		{target: 0.475, relErr: 0.03},
+		{target: 0.975, relErr: 0.03},
+		{target: 0.94, relErr: 0.1},
+		{target: 0.96, relErr: 0.1},
+	} {
+		if got, want := p.Quantile(tt.target), exact(values, tt.target); math.Abs(got-want) > tt.relErr*want {
+			t.Errorf("exponential Quantile(%v) = %v, want within %v%% of %v", tt.target, got, tt.relErr*100, want)
+		}
+	}
+	nearErr := math.Abs(p.Quantile(0.96) - exact(values, 0.96))
+	farErr := math.Abs(p.Quantile(0.75) - exact(values, 0.75))
+	if farErr <= nearErr {
+		t.Errorf("exponential Quantile error far from Perc %v, close to Perc %v, want it to degrade further away", farErr, nearErr)
+	}
+
+	// The extremes are known exactly, and targets outside [0, 1] are clamped
+	if got := p.Quantile(-1); got != values[0] {
+		t.Errorf("Quantile(-1) = %v, want the minimum %v", got, values[0])
+	}
+	if got := p.Quantile(2); got != values[n-1] {
+		t.Errorf("Quantile(2) = %v, want the maximum %v", got, values[n-1])
+	}
+
+	if got := p.Quantile(0.95); got != p.Get() {
+		t.Errorf("Quantile(Perc) = %v, want Get() = %v", got, p.Get())
+	}
+
+	// Fewer than five observations fall back to Get
+	few := NewPsqr(0.95)
+	for _, v := range []float64{4, 1, 3} {
+		few.Add(v)
+	}
+	for _, target := range []float64{0, 0.5, 1} {
+		if got := few.Quantile(target); got != few.Get() {
+			t.Errorf("Quantile(%v) after three observations = %v, want Get() = %v", target, got, few.Get())
+		}
+	}
+}
+
+func TestAddWeightedApproximatesRepeatedAdd(t *testing.T) {
+	const weight = 10
+
+	r := rand.New(rand.NewSource(1))
+	for _, perc := range []float64{0.5, 0.95} {
+		weighted, expanded := NewPsqr(perc), NewPsqr(perc)
+		for i := 0; i < 2000; i++ {
+			v := r.Float64() * 1000
+			weighted.AddWeighted(v, weight)
+			for j := 0; j < weight; j++ {
+				expanded.Add(v)
+			}
+		}
+
+		if weighted.Count() != expanded.Count() {
+			t.Errorf("p%v: Count() weighted = %d, expanded = %d", perc*100, weighted.Count(), expanded.Count())
+		}
+		if got, want := weighted.Get(), expanded.Get(); math.Abs(got-want) > 10 {
+			t.Errorf("p%v: Get() weighted = %v, want within 10 of the expanded %v", perc*100, got, want)
+		}
+	}
+
+	// A weighted observation collected during the first five fills the remaining slots
+	p := NewPsqr(0.95)
+	p.Add(1)
+	p.AddWeighted(2, weight)
+	if got := p.Count(); got != 1+weight {
+		t.Errorf("Count() after a weighted observation during warmup = %d, want %d", got, 1+weight)
+	}
+	if q, _ := p.Markers(); q != [5]float64{1, 2, 2, 2, 2} {
+		t.Errorf("Markers() after a weighted observation during warmup = %v, want [1 2 2 2 2]", q)
+	}
+
+	// A weight of 0 or less is ignored
+	state := p.State()
+	for _, weight := range []int{0, -1} {
+		p.AddWeighted(1000, weight)
+		if p.State() != state {
+			t.Errorf("AddWeighted() with weight %d changed the estimator", weight)
+		}
+	}
+}
+
+func TestStabilityDecreasesOnStationaryStream(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	p := NewPsqr(0.95)
+
+	for i := 0; i < 4; i++ {
+		p.Add(r.Float64())
+		if got := p.Stability(); got != 1 {
+			t.Fatalf("Stability() after %d observations = %v, want 1", i+1, got)
+		}
+	}
+
+	previous := 1.0
+	added := 4
+	for _, checkpoint := range []int{10, 100, 1000, 10000} {
+		for ; added < checkpoint; added++ {
+			p.Add(r.Float64())
+		}
+
+		got := p.Stability()
+		if got >= previous {
+			t.Errorf("Stability() after %d observations = %v, want it below the %v before", checkpoint, got, previous)
+		}
+		previous = got
+	}
+	if previous > 0.01 {
+		t.Errorf("Stability() after 10000 observations = %v, want it close to 0", previous)
+	}
+}
+
+func TestResetSeededConvergence(t *testing.T) {
+	const runs, warm, seed = 50, 1000, 100
+
+	// estimate returns the estimates of a cold and a seeded estimator after n more observations, both started
+	// from an estimator that collected warm uniform observations between 0 and 1000
+	estimate := func(r *rand.Rand, n int, next func() float64) (cold float64, seeded float64) {
+		p := NewPsqr(0.95)
+		for i := 0; i < warm; i++ {
+			p.Add(r.Float64() * 1000)
+		}
+
+		s := NewPsqr(0.95)
+		s.Restore(p.State())
+		s.ResetSeeded(seed)
+		p.Reset()
+
+		for i := 0; i < n; i++ {
+			v := next()
+			p.Add(v)
+			s.Add(v)
+		}
+		return p.Get(), s.Get()
+	}
+
+	var coldErr, seededErr float64
+	r := rand.New(rand.NewSource(1))
+	for run := 0; run < runs; run++ {
+		cold, seeded := estimate(r, 20, func() float64 { return r.Float64() * 1000 })
+		coldErr += math.Abs(cold - 950)
+		seededErr += math.Abs(seeded - 950)
+	}
+	if seededErr >= coldErr {
+		t.Errorf("stationary stream: mean error seeded %v, cold %v, want the seeded estimate closer", seededErr/runs, coldErr/runs)
+	}
+
+	// After a step to uniform observations between 2000 and 3000 the seed holds the estimate back
+	coldErr, seededErr = 0, 0
+	for run := 0; run < runs; run++ {
+		cold, seeded := estimate(r, 50, func() float64 { return 2000 + r.Float64()*1000 })
+		coldErr += math.Abs(cold - 2950)
+		seededErr += math.Abs(seeded - 2950)
+	}
+	if seededErr <= coldErr {
+		t.Errorf("after a step change: mean error seeded %v, cold %v, want the cold estimate closer", seededErr/runs, coldErr/runs)
+	}
+}
+
+// fuzzInput encodes observations the way FuzzPsqrAdd decodes them, eight little endian bytes each.
+func fuzzInput(values ...float64) []byte {
+	data := make([]byte, 0, 8*len(values))
+	for _, v := range values {
+		data = binary.LittleEndian.AppendUint64(data, math.Float64bits(v))
+	}
+	return data
+}
+
+func FuzzPsqrAdd(f *testing.F) {
+	identical := make([]float64, 50)
+	alternating := make([]float64, 50)
+	for i := range identical {
+		identical[i] = 42
+		alternating[i] = float64(i%2) * 1e6
+	}
+
+	f.Add(0.95, fuzzInput(1, 2, 3, 4, 5, 6, 7, 8, 9, 10))
+	f.Add(0.5, fuzzInput(identical...))
+	f.Add(0.95, fuzzInput(alternating...))
+	f.Add(0.99, fuzzInput(math.NaN(), 1, math.Inf(1), 2, math.Inf(-1), 3, 4, 5, 6, math.NaN()))
+	f.Add(0.95, fuzzInput(-math.MaxFloat64, math.MaxFloat64, 0, -math.MaxFloat64, math.MaxFloat64, 1, -1, 0))
+
+	f.Fuzz(func(t *testing.T, perc float64, data []byte) {
+		if !(perc > 0 && perc < 1) {
+			t.Skip()
+		}
+
+		p := NewPsqr(perc)
+		finite := 0
+		lo, hi := math.Inf(1), math.Inf(-1)
+
+		for ; len(data) >= 8; data = data[8:] {
+			v := math.Float64frombits(binary.LittleEndian.Uint64(data))
+			got := p.Add(v)
+
+			if !math.IsNaN(v) && !math.IsInf(v, 0) {
+				finite++
+				lo, hi = math.Min(lo, v), math.Max(hi, v)
+			}
+
+			if p.Count() != finite {
+				t.Fatalf("Count() = %d after %d finite observations", p.Count(), finite)
+			}
+			if finite < 5 {
+				continue
+			}
+
+			if got != p.Get() {
+				t.Fatalf("Add() = %v, Get() = %v", got, p.Get())
+			}
+			if math.IsNaN(got) || got < lo || got > hi {
+				t.Fatalf("Get() = %v, want within [%v, %v]", got, lo, hi)
+			}
+
+			q, n := p.Markers()
+			for i := 1; i < 5; i++ {
+				if math.IsNaN(q[i]) || q[i] < q[i-1] || n[i] <= n[i-1] {
+					t.Fatalf("markers out of order: heights %v, positions %v", q, n)
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkPsqrAdd(b *testing.B) {
+	const size = 1 << 16
+
+	uniform := make([]float64, size)
+	r := rand.New(rand.NewSource(1))
+	for i := range uniform {
+		uniform[i] = r.Float64() * 1000
+	}
+
+	ascending := make([]float64, size)
+	descending := make([]float64, size)
+	for i := range ascending {
+		ascending[i] = float64(i)
+		descending[i] = float64(size - i)
+	}
+
+	for _, bm := range []struct {
+		name   string
+		values []float64
+	}{
+		{name: "uniform", values: uniform},
+		{name: "ascending", values: ascending},
+		{name: "descending", values: descending},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			p := NewPsqr(0.95)
+			for i := 0; i < b.N; i++ {
+				p.Add(bm.values[i%size])
+			}
+		})
+	}
+}